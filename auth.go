@@ -0,0 +1,324 @@
+package pgtwixt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// Authentication request codes of the protocol.
+const (
+	authOK           = 0
+	authCleartext    = 3
+	authMD5          = 5
+	authSASL         = 10
+	authSASLContinue = 11
+	authSASLFinal    = 12
+)
+
+// Authenticator verifies the password of a frontend before any backend is
+// opened for it.
+type Authenticator struct {
+	// Method is "scram-sha-256", "md5", or "password" as in pg_hba.conf.
+	// For users with a SCRAM secret, "md5" uses SCRAM as PostgreSQL does.
+	Method string
+
+	// Secret returns the password of a user, the "md5" hash of it, or the
+	// SCRAM verifier of it as stored in pg_authid.
+	Secret func(user string) (string, bool)
+}
+
+// Authenticate exchanges authentication messages with a frontend that has
+// sent startup. A frontend that fails is sent an ErrorResponse, which is also
+// returned. Authenticate does not send AuthenticationOk.
+func (a Authenticator) Authenticate(fe FrontendStream, startup map[string]string) error {
+	user := startup["user"]
+	secret, ok := a.Secret(user)
+
+	var err error
+	switch a.Method {
+	case "password":
+		err = a.password(fe, user, secret)
+	case "md5", "scram-sha-256":
+		if a.Method == "md5" && !strings.HasPrefix(secret, scramSHA256+"$") {
+			err = a.md5(fe, user, secret)
+		} else {
+			err = a.scram(fe, secret, ok)
+		}
+	default:
+		return fmt.Errorf("unknown authentication method: %q", a.Method)
+	}
+
+	// Unknown users go through the same exchange so they cannot be told apart.
+	if err == nil && !ok {
+		err = errPasswordFailed
+	}
+	if err == errPasswordFailed {
+		err = fatal(fe, "28P01", fmt.Sprintf("password authentication failed for user %q", user))
+	}
+	return err
+}
+
+var errPasswordFailed = errors.New("password authentication failed")
+
+// request sends an authentication request and reads the response.
+func (Authenticator) request(fe FrontendStream, code uint32, data []byte) ([]byte, error) {
+	var msg core.Message
+	initAuthentication(&msg, code, data)
+
+	if err := fe.Send(&msg); err != nil {
+		return nil, err
+	}
+	if err := fe.Flush(); err != nil {
+		return nil, err
+	}
+	if err := fe.Next(&msg); err != nil {
+		return nil, err
+	}
+	if msg.MsgType() != proto.MsgPasswordMessageP {
+		return nil, fmt.Errorf("expected password response, got %q", msg.MsgType())
+	}
+	return msg.Force()
+}
+
+func (a Authenticator) password(fe FrontendStream, user, secret string) error {
+	b, err := a.request(fe, authCleartext, nil)
+	if err != nil {
+		return err
+	}
+
+	password, err := buf.ReadCString(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	var match bool
+	switch {
+	case strings.HasPrefix(secret, scramSHA256+"$"):
+		var v scramSecret
+		if v, err = parseSCRAMSecret(secret); err != nil {
+			return err
+		}
+		salted := scramSaltedPassword(password, v.salt, v.iterations)
+		match = hmac.Equal(v.storedKey, scramHash(scramHMAC(salted, "Client Key")))
+	case isMD5Secret(secret):
+		match = subtle.ConstantTimeCompare([]byte(secret), []byte(md5Secret(user, password))) == 1
+	default:
+		match = subtle.ConstantTimeCompare([]byte(secret), []byte(password)) == 1
+	}
+
+	if !match {
+		return errPasswordFailed
+	}
+	return nil
+}
+
+func (a Authenticator) md5(fe FrontendStream, user, secret string) error {
+	salt := make([]byte, 4)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	b, err := a.request(fe, authMD5, salt)
+	if err != nil {
+		return err
+	}
+
+	response, err := buf.ReadCString(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	if !isMD5Secret(secret) {
+		secret = md5Secret(user, secret)
+	}
+	if subtle.ConstantTimeCompare([]byte(response), []byte(md5Response(secret, salt))) != 1 {
+		return errPasswordFailed
+	}
+	return nil
+}
+
+func (a Authenticator) scram(fe FrontendStream, secret string, ok bool) error {
+	var v scramSecret
+	var err error
+
+	switch {
+	case !ok || isMD5Secret(secret):
+		// SCRAM cannot use an md5 hash, so the exchange is bound to fail.
+		v, err = newSCRAMSecret(secret+"\x00", 4096)
+		ok = false
+	case strings.HasPrefix(secret, scramSHA256+"$"):
+		v, err = parseSCRAMSecret(secret)
+	default:
+		v, err = newSCRAMSecret(secret, 4096)
+	}
+	if err != nil {
+		return err
+	}
+
+	// client-first-message
+	b, err := a.request(fe, authSASL, []byte(scramSHA256+"\x00\x00"))
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(b)
+	mechanism, err := buf.ReadCString(r)
+	if err != nil {
+		return err
+	}
+	if mechanism != scramSHA256 {
+		return fmt.Errorf("unsupported SASL mechanism: %q", mechanism)
+	}
+
+	var size int32
+	if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size < 0 || int(size) != r.Len() {
+		return errors.New("malformed SASL initial response")
+	}
+	clientFirst := string(b[len(b)-r.Len():])
+
+	// gs2-header is a channel binding flag and an authzid, e.g. "n,,".
+	i := strings.Index(clientFirst, ",")
+	j := strings.Index(clientFirst[i+1:], ",") + i + 1
+	if i < 0 || j <= i || (clientFirst[0] != 'n' && clientFirst[0] != 'y') {
+		return errors.New("unsupported SCRAM channel binding")
+	}
+	header, clientFirstBare := clientFirst[:j+1], clientFirst[j+1:]
+
+	clientNonce := scramAttributes(clientFirstBare)['r']
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+	if clientNonce == "" {
+		return errors.New("malformed SCRAM client-first-message")
+	}
+
+	// server-first-message and client-final-message
+	nonce := clientNonce + serverNonce
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce,
+		base64.StdEncoding.EncodeToString(v.salt), v.iterations)
+
+	b, err = a.request(fe, authSASLContinue, []byte(serverFirst))
+	if err != nil {
+		return err
+	}
+
+	clientFinal := string(b)
+	attrs := scramAttributes(clientFinal)
+	k := strings.LastIndex(clientFinal, ",p=")
+	if k < 0 || attrs['r'] != nonce || attrs['c'] != base64.StdEncoding.EncodeToString([]byte(header)) {
+		return errors.New("malformed SCRAM client-final-message")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(attrs['p'])
+	if err != nil {
+		return err
+	}
+
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal[:k]
+	signature := scramHMAC(v.storedKey, authMessage)
+	if len(proof) != len(signature) {
+		return errPasswordFailed
+	}
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	if !hmac.Equal(scramHash(proof), v.storedKey) || !ok {
+		return errPasswordFailed
+	}
+
+	// server-final-message
+	var msg core.Message
+	initAuthentication(&msg, authSASLFinal,
+		[]byte("v="+base64.StdEncoding.EncodeToString(scramHMAC(v.serverKey, authMessage))))
+	return fe.Send(&msg)
+}
+
+func isMD5Secret(s string) bool {
+	return len(s) == 35 && strings.HasPrefix(s, "md5")
+}
+
+// md5Secret is the hash PostgreSQL stores for an md5 password.
+func md5Secret(user, password string) string {
+	h := md5.Sum([]byte(password + user))
+	return "md5" + hex.EncodeToString(h[:])
+}
+
+// md5Response is the response to an AuthenticationMD5Password request.
+func md5Response(secret string, salt []byte) string {
+	h := md5.Sum(append([]byte(secret[3:]), salt...))
+	return "md5" + hex.EncodeToString(h[:])
+}
+
+// Credentials maps user names to secrets for an Authenticator.
+type Credentials map[string]string
+
+func (c Credentials) Secret(user string) (string, bool) {
+	s, ok := c[user]
+	return s, ok
+}
+
+// ReadCredentials parses lines of `"user" "secret"` as in the auth_file of
+// PgBouncer. Blank lines and lines that start with ";" or "#" are ignored.
+func ReadCredentials(r io.Reader) (Credentials, error) {
+	c := make(Credentials)
+	s := bufio.NewScanner(r)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		var fields []string
+		for len(fields) < 2 {
+			field, rest, ok := readQuoted(line)
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected quoted user and secret", n)
+			}
+			fields = append(fields, field)
+			line = strings.TrimLeft(rest, " \t")
+		}
+		c[fields[0]] = fields[1]
+	}
+
+	return c, s.Err()
+}
+
+// readQuoted reads a double-quoted string in which "" is a literal quote.
+func readQuoted(s string) (value, rest string, ok bool) {
+	if len(s) == 0 || s[0] != '"' {
+		return "", s, false
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			b.WriteByte(s[i])
+		} else if i+1 < len(s) && s[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+		} else {
+			return b.String(), s[i+1:], true
+		}
+	}
+	return "", s, false
+}
@@ -0,0 +1,224 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// authClient answers authentication requests the way libpq does.
+func authClient(s *core.MessageStream, user, password string) error {
+	var msg core.Message
+	var clientFirstBare, serverFirst, clientFinal string
+	var salted []byte
+
+	respond := func(b []byte) error {
+		msg.InitFromBytes(proto.MsgPasswordMessageP, b)
+		if err := s.Send(&msg); err != nil {
+			return err
+		}
+		return s.Flush()
+	}
+
+	for {
+		if err := s.Next(&msg); err != nil {
+			return err
+		}
+		if msg.MsgType() == proto.MsgErrorResponseE {
+			return readErrorResponse(&msg)
+		}
+
+		code, data, err := readAuthentication(&msg)
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case authCleartext:
+			err = respond([]byte(password + "\x00"))
+
+		case authMD5:
+			err = respond([]byte(md5Response(md5Secret(user, password), data) + "\x00"))
+
+		case authSASL:
+			clientFirstBare = "n=,r=client"
+			b := bytes.NewBufferString(scramSHA256 + "\x00")
+			_ = binary.Write(b, binary.BigEndian, int32(len(clientFirstBare)+3))
+			b.WriteString("n,," + clientFirstBare)
+			err = respond(b.Bytes())
+
+		case authSASLContinue:
+			serverFirst = string(data)
+			attrs := scramAttributes(serverFirst)
+			salt, _ := base64.StdEncoding.DecodeString(attrs['s'])
+			var iterations int
+			_, _ = fmt.Sscan(attrs['i'], &iterations)
+
+			salted = scramSaltedPassword(password, salt, iterations)
+			clientKey := scramHMAC(salted, "Client Key")
+			clientFinal = "c=biws,r=" + attrs['r']
+			signature := scramHMAC(scramHash(clientKey), clientFirstBare+","+serverFirst+","+clientFinal)
+			for i := range clientKey {
+				clientKey[i] ^= signature[i]
+			}
+			err = respond([]byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(clientKey)))
+
+		case authSASLFinal:
+			expected := scramHMAC(scramHMAC(salted, "Server Key"), clientFirstBare+","+serverFirst+","+clientFinal)
+			if string(data) != "v="+base64.StdEncoding.EncodeToString(expected) {
+				return fmt.Errorf("wrong server signature: %q", data)
+			}
+
+		case authOK:
+			return nil
+
+		default:
+			return fmt.Errorf("unexpected authentication request: %d", code)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	scram, err := newSCRAMSecret("secret", 4096)
+	require.NoError(t, err)
+
+	credentials := Credentials{
+		"plain": "secret",
+		"md5":   md5Secret("md5", "secret"),
+		"scram": scram.String(),
+	}
+
+	authenticate := func(method, user, password string) (error, error) {
+		conn, client := net.Pipe()
+		defer conn.Close()
+
+		a := Authenticator{Method: method, Secret: credentials.Secret}
+		done := make(chan error, 1)
+		go func() {
+			done <- authClient(core.NewBackendStream(client), user, password)
+			client.Close()
+		}()
+
+		fe := FrontendStream{
+			debug:  func(...interface{}) error { return nil },
+			stream: core.NewBackendStream(conn),
+		}
+		err := a.Authenticate(fe, map[string]string{"user": user})
+		if err == nil {
+			var msg core.Message
+			proto.InitAuthenticationOk(&msg)
+			_ = fe.Send(&msg)
+			_ = fe.Flush()
+		}
+		conn.Close()
+		return err, <-done
+	}
+
+	for _, method := range []string{"password", "md5", "scram-sha-256"} {
+		for _, user := range []string{"plain", "md5", "scram"} {
+			method, user := method, user
+			t.Run(method+","+user, func(t *testing.T) {
+				if method == "scram-sha-256" && user == "md5" {
+					t.Skip("SCRAM cannot use an md5 hash")
+				}
+
+				server, client := authenticate(method, user, "secret")
+				assert.NoError(t, server)
+				assert.NoError(t, client)
+
+				server, client = authenticate(method, user, "wrong")
+				require.IsType(t, ErrorResponse{}, server)
+				assert.Equal(t, "28P01", server.(ErrorResponse).Fields['C'])
+				require.IsType(t, ErrorResponse{}, client, "Expected the frontend to be told")
+				assert.Equal(t, "28P01", client.(ErrorResponse).Fields['C'])
+			})
+		}
+
+		t.Run(method+",unknown", func(t *testing.T) {
+			server, _ := authenticate(method, "nobody", "")
+			assert.IsType(t, ErrorResponse{}, server)
+		})
+	}
+
+	t.Run("UnknownMethod", func(t *testing.T) {
+		a := Authenticator{Method: "trust", Secret: credentials.Secret}
+		assert.Error(t, a.Authenticate(FrontendStream{}, map[string]string{"user": "plain"}))
+	})
+}
+
+func TestReadCredentials(t *testing.T) {
+	t.Parallel()
+
+	c, err := ReadCredentials(strings.NewReader(`
+; comment
+"mary" "secret"
+# comment
+"with ""quote"""   "md5abc"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{"mary": "secret", `with "quote"`: "md5abc"}, c)
+
+	_, err = ReadCredentials(strings.NewReader(`mary secret`))
+	assert.Error(t, err)
+
+	_, err = ReadCredentials(strings.NewReader(`"mary"`))
+	assert.Error(t, err)
+}
+
+func TestSCRAMSecret(t *testing.T) {
+	t.Parallel()
+
+	v, err := newSCRAMSecret("secret", 4096)
+	require.NoError(t, err)
+	assert.Len(t, v.salt, 16)
+
+	parsed, err := parseSCRAMSecret(v.String())
+	require.NoError(t, err)
+	assert.Equal(t, v, parsed)
+
+	salted := scramSaltedPassword("secret", parsed.salt, parsed.iterations)
+	assert.Equal(t, parsed.storedKey, scramHash(scramHMAC(salted, "Client Key")))
+	assert.Equal(t, parsed.serverKey, scramHMAC(salted, "Server Key"))
+
+	for _, s := range []string{"md5abc", "SCRAM-SHA-256$x:abc$def:ghi", "SCRAM-SHA-256$4096$abc"} {
+		_, err = parseSCRAMSecret(s)
+		assert.Error(t, err, "%q", s)
+	}
+}
+
+// TestSCRAMSaltedPassword checks Hi() against the test vector of RFC 7677.
+func TestSCRAMSaltedPassword(t *testing.T) {
+	t.Parallel()
+
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	require.NoError(t, err)
+
+	salted := scramSaltedPassword("pencil", salt, 4096)
+	clientKey := scramHMAC(salted, "Client Key")
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+
+	signature := scramHMAC(scramHash(clientKey), authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	assert.Equal(t, "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", base64.StdEncoding.EncodeToString(clientKey))
+
+	serverSignature := scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	assert.Equal(t, "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", base64.StdEncoding.EncodeToString(serverSignature))
+}
@@ -0,0 +1,258 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// Backend is a BackendStream that has completed startup. It tracks the
+// transaction status of the latest ReadyForQuery so it can be shared between
+// frontends.
+type Backend struct {
+	BackendStream
+
+	Key        CancellationKey
+	Parameters map[string]string
+	Status     proto.ConnStatus
+
+	key     string
+	created time.Time
+	used    time.Time
+}
+
+// login reads the response to a StartupMessage through the first
+// ReadyForQuery, answering authentication requests with password. When
+// channelBinding is "require", the backend must use SCRAM with channel binding.
+func (b *Backend) login(user, password, channelBinding string) error {
+	var msg core.Message
+	var scram *scramClient
+
+	b.Parameters = make(map[string]string)
+	b.created = time.Now()
+
+	for {
+		if err := b.Next(&msg); err != nil {
+			return err
+		}
+
+		switch msg.MsgType() {
+		case proto.MsgAuthenticationOkR:
+			code, data, err := readAuthentication(&msg)
+			if err != nil {
+				return err
+			}
+			if code == authOK {
+				if channelBinding == "require" && (scram == nil || !strings.HasPrefix(scram.header, "p=")) {
+					return errors.New("channel binding required but not used by the backend")
+				}
+				continue
+			}
+			// Refuse anything but SCRAM before a password could be sent to a
+			// backend that might be an impostor.
+			if channelBinding == "require" && code != authSASL && code != authSASLContinue && code != authSASLFinal {
+				return errors.New("channel binding required but not offered by the backend")
+			}
+			if code != authSASLContinue && code != authSASLFinal && password == "" {
+				return errors.New("backend requested a password but none was supplied")
+			}
+
+			switch code {
+			case authCleartext:
+				err = b.respond([]byte(password + "\x00"))
+
+			case authMD5:
+				err = b.respond([]byte(md5Response(md5Secret(user, password), data) + "\x00"))
+
+			case authSASL:
+				scram = &scramClient{password: password}
+				if tc, ok := b.conn.(*tls.Conn); ok && channelBinding != "disable" {
+					scram.binding = tlsServerEndPoint(tc.ConnectionState())
+				}
+
+				var mechanism string
+				var response []byte
+				mechanism, response, err = scram.initial(strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"))
+				if err == nil && channelBinding == "require" && mechanism != scramSHA256Plus {
+					err = errors.New("channel binding required but not offered by the backend")
+				}
+				if err == nil {
+					r := bytes.NewBuffer(nil)
+					_, _ = buf.WriteCString(r, mechanism)
+					_, _ = buf.WriteInt32(r, int32(len(response)))
+					_, _ = r.Write(response)
+					err = b.respond(r.Bytes())
+				}
+
+			case authSASLContinue:
+				var response []byte
+				if scram == nil {
+					err = errors.New("unexpected SASL continue request")
+				} else if response, err = scram.final(data); err == nil {
+					err = b.respond(response)
+				}
+
+			case authSASLFinal:
+				if scram == nil {
+					err = errors.New("unexpected SASL final request")
+				} else {
+					err = scram.verify(data)
+				}
+
+			default:
+				err = fmt.Errorf("unsupported authentication request: %d", code)
+			}
+			if err != nil {
+				return err
+			}
+
+		case proto.MsgBackendKeyDataK:
+			var err error
+			if b.Key, err = readBackendKeyData(&msg); err != nil {
+				return err
+			}
+
+		case proto.MsgParameterStatusS:
+			name, value, err := readParameterStatus(&msg)
+			if err != nil {
+				return err
+			}
+			b.Parameters[name] = value
+
+		case proto.MsgErrorResponseE:
+			return readErrorResponse(&msg)
+
+		case proto.MsgReadyForQueryZ:
+			var err error
+			b.Status, err = readReadyForQuery(&msg)
+			return err
+
+		default:
+			if err := msg.Discard(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// respond sends a PasswordMessage, or any of the other messages that share
+// its type, to an authentication request.
+func (b *Backend) respond(data []byte) error {
+	var msg core.Message
+	msg.InitFromBytes(proto.MsgPasswordMessageP, data)
+
+	if err := b.Send(&msg); err != nil {
+		return err
+	}
+	return b.Flush()
+}
+
+// exec sends a simple Query and reads through the next ReadyForQuery. It
+// returns the first column of every row as text.
+func (b *Backend) exec(sql string) ([]string, error) {
+	var msg core.Message
+	var rows []string
+	var failed error
+
+	proto.InitQuery(&msg, sql)
+	if err := b.Send(&msg); err != nil {
+		return nil, err
+	}
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := b.Next(&msg); err != nil {
+			return nil, err
+		}
+
+		switch msg.MsgType() {
+		case proto.MsgDataRowD:
+			if err := force(&msg); err != nil {
+				return nil, err
+			}
+			r, err := proto.ReadDataRow(&msg)
+			if err != nil {
+				return nil, err
+			}
+			if len(r.Values) > 0 {
+				rows = append(rows, string(r.Values[0]))
+			}
+
+		case proto.MsgErrorResponseE:
+			failed = readErrorResponse(&msg)
+
+		case proto.MsgParameterStatusS:
+			name, value, err := readParameterStatus(&msg)
+			if err != nil {
+				return nil, err
+			}
+			b.Parameters[name] = value
+
+		case proto.MsgReadyForQueryZ:
+			var err error
+			if b.Status, err = readReadyForQuery(&msg); err == nil {
+				err = failed
+			}
+			return rows, err
+
+		default:
+			if err := msg.Discard(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// setting returns the value of a parameter that the backend reports in
+// ParameterStatus, or asks for it with sql when it does not.
+func (b *Backend) setting(name, sql string) (string, error) {
+	if value, ok := b.Parameters[name]; ok {
+		return value, nil
+	}
+	rows, err := b.exec(sql)
+	if err == nil && len(rows) != 1 {
+		err = fmt.Errorf("unexpected result of %q: %v", sql, rows)
+	}
+	if err != nil {
+		return "", err
+	}
+	return rows[0], nil
+}
+
+// matches reports whether the backend satisfies the "target_session_attrs"
+// of a connection string.
+func (b *Backend) matches(attrs string) (bool, error) {
+	var value string
+	var err error
+
+	switch attrs {
+	case "", "any":
+		return true, nil
+	case "read-write", "read-only":
+		// A hot standby is read-only whatever its default.
+		if b.Parameters["in_hot_standby"] == "on" {
+			return attrs == "read-only", nil
+		}
+		// Servers before 14 do not report default_transaction_read_only.
+		if value, err = b.setting("default_transaction_read_only", "SHOW transaction_read_only"); err == nil {
+			return (value == "on") == (attrs == "read-only"), nil
+		}
+	case "primary", "standby", "prefer-standby":
+		// Servers before 14 do not report in_hot_standby.
+		if value, err = b.setting("in_hot_standby", "SELECT pg_catalog.pg_is_in_recovery()"); err == nil {
+			return (value == "on" || value == "t") == (attrs != "primary"), nil
+		}
+	default:
+		err = fmt.Errorf("invalid target_session_attrs: %q", attrs)
+	}
+	return false, err
+}
@@ -0,0 +1,262 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+func TestBackendLogin(t *testing.T) {
+	t.Parallel()
+
+	conn, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		var msg core.Message
+		be := core.NewBackendStream(server)
+
+		proto.InitAuthenticationOk(&msg)
+		_ = be.Send(&msg)
+		initParameterStatus(&msg, "server_version", "11.1")
+		_ = be.Send(&msg)
+		initBackendKeyData(&msg, CancellationKey{id: 2600, secret: 1957})
+		_ = be.Send(&msg)
+		proto.InitReadyForQuery(&msg, proto.RfqIdle)
+		_ = be.Send(&msg)
+	}()
+
+	b := Backend{BackendStream: BackendStream{
+		debug:  func(...interface{}) error { return nil },
+		stream: core.NewBackendStream(conn),
+	}}
+	require.NoError(t, b.login("", "", ""))
+
+	assert.Equal(t, CancellationKey{id: 2600, secret: 1957}, b.Key)
+	assert.Equal(t, map[string]string{"server_version": "11.1"}, b.Parameters)
+	assert.Equal(t, proto.RfqIdle, b.Status)
+}
+
+func TestBackendLoginError(t *testing.T) {
+	t.Parallel()
+
+	var msg core.Message
+	buf := bytes.NewBuffer(nil)
+	msg.InitFromBytes(proto.MsgErrorResponseE, []byte("SFATAL\x00C28000\x00Mnope\x00\x00"))
+	_, _ = msg.WriteTo(buf)
+
+	b := Backend{BackendStream: BackendStream{
+		debug:  func(...interface{}) error { return nil },
+		stream: core.NewBackendStream(nopCloser{buf}),
+	}}
+
+	err := b.login("", "", "")
+	require.IsType(t, ErrorResponse{}, err)
+	assert.Equal(t, "28000", err.(ErrorResponse).Fields['C'])
+}
+
+func TestBackendMatches(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ParameterStatus", func(t *testing.T) {
+		b := Backend{Parameters: map[string]string{
+			"default_transaction_read_only": "off",
+			"in_hot_standby":                "off",
+		}}
+
+		for attrs, expected := range map[string]bool{
+			"": true, "any": true,
+			"read-write": true, "read-only": false,
+			"primary": true, "standby": false, "prefer-standby": false,
+		} {
+			ok, err := b.matches(attrs)
+			require.NoError(t, err)
+			assert.Equal(t, expected, ok, "%q", attrs)
+		}
+
+		_, err := b.matches("bogus")
+		assert.Error(t, err)
+	})
+
+	t.Run("HotStandby", func(t *testing.T) {
+		for _, parameters := range []map[string]string{
+			{"default_transaction_read_only": "off", "in_hot_standby": "on"},
+			{"default_transaction_read_only": "on", "in_hot_standby": "on"},
+		} {
+			b := Backend{Parameters: parameters}
+
+			for attrs, expected := range map[string]bool{
+				"read-write": false, "read-only": true,
+				"primary": false, "standby": true,
+			} {
+				ok, err := b.matches(attrs)
+				require.NoError(t, err)
+				assert.Equal(t, expected, ok, "%q %v", attrs, parameters)
+			}
+		}
+
+		b := Backend{Parameters: map[string]string{
+			"default_transaction_read_only": "on",
+			"in_hot_standby":                "off",
+		}}
+		ok, err := b.matches("read-only")
+		require.NoError(t, err)
+		assert.True(t, ok, "Expected a read-only primary")
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		conn, server := net.Pipe()
+		defer server.Close()
+
+		go func() {
+			var msg core.Message
+			fe := core.NewBackendStream(server)
+			if fe.Next(&msg) != nil || msg.Discard() != nil {
+				return
+			}
+
+			msg.InitFromBytes(proto.MsgDataRowD, []byte{0, 1, 0, 0, 0, 1, 't'})
+			_ = fe.Send(&msg)
+			proto.InitReadyForQuery(&msg, proto.RfqIdle)
+			_ = fe.Send(&msg)
+		}()
+
+		b := Backend{
+			BackendStream: BackendStream{
+				debug:  func(...interface{}) error { return nil },
+				stream: core.NewBackendStream(conn),
+			},
+			Parameters: map[string]string{},
+		}
+
+		ok, err := b.matches("standby")
+		require.NoError(t, err)
+		assert.True(t, ok, "Expected the server to be asked when it does not report")
+	})
+}
+
+func TestBackendLoginPassword(t *testing.T) {
+	t.Parallel()
+
+	scram, err := newSCRAMSecret("secret", 4096)
+	require.NoError(t, err)
+	credentials := Credentials{"mary": scram.String(), "bob": "secret"}
+
+	login := func(method, user, password string) error {
+		conn, server := net.Pipe()
+		defer server.Close()
+
+		go func() {
+			var msg core.Message
+			fe := FrontendStream{
+				debug:  func(...interface{}) error { return nil },
+				stream: core.NewBackendStream(server),
+			}
+			a := Authenticator{Method: method, Secret: credentials.Secret}
+			if a.Authenticate(fe, map[string]string{"user": user}) == nil {
+				proto.InitAuthenticationOk(&msg)
+				_ = fe.Send(&msg)
+				proto.InitReadyForQuery(&msg, proto.RfqIdle)
+				_ = fe.Send(&msg)
+				_ = fe.Flush()
+			}
+		}()
+
+		b := Backend{BackendStream: BackendStream{
+			debug:  func(...interface{}) error { return nil },
+			stream: core.NewBackendStream(conn),
+		}}
+		return b.login(user, password, "")
+	}
+
+	for _, tt := range []struct{ method, user string }{
+		{"password", "bob"},
+		{"md5", "bob"},
+		{"scram-sha-256", "bob"},
+		{"scram-sha-256", "mary"},
+	} {
+		t.Run(tt.method+","+tt.user, func(t *testing.T) {
+			assert.NoError(t, login(tt.method, tt.user, "secret"))
+
+			err := login(tt.method, tt.user, "wrong")
+			require.IsType(t, ErrorResponse{}, err)
+			assert.Equal(t, "28P01", err.(ErrorResponse).Fields['C'])
+
+			assert.EqualError(t, login(tt.method, tt.user, ""),
+				"backend requested a password but none was supplied")
+		})
+	}
+}
+
+func TestBackendLoginChannelBinding(t *testing.T) {
+	t.Parallel()
+
+	var msg core.Message
+	buf := bytes.NewBuffer(nil)
+	proto.InitAuthenticationOk(&msg)
+	_, _ = msg.WriteTo(buf)
+
+	b := Backend{BackendStream: BackendStream{
+		debug:  func(...interface{}) error { return nil },
+		stream: core.NewBackendStream(nopCloser{buf}),
+	}}
+	assert.Error(t, b.login("mary", "secret", "require"),
+		"Expected an error when the backend skips SCRAM")
+
+	t.Run("Refused", func(t *testing.T) {
+		for name, request := range map[string]func(*core.Message){
+			"Cleartext": func(m *core.Message) { initAuthentication(m, authCleartext, nil) },
+			"MD5":       func(m *core.Message) { initAuthentication(m, authMD5, []byte{1, 2, 3, 4}) },
+			"SCRAM":     func(m *core.Message) { initAuthentication(m, authSASL, []byte(scramSHA256+"\x00\x00")) },
+		} {
+			in, out := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+			request(&msg)
+			_, _ = msg.WriteTo(in)
+
+			b := Backend{BackendStream: BackendStream{
+				debug: func(...interface{}) error { return nil },
+				stream: core.NewBackendStream(nopCloser{struct {
+					io.Reader
+					io.Writer
+				}{in, out}}),
+			}}
+			assert.Error(t, b.login("mary", "secret", "require"), name)
+			assert.Zero(t, out.Len(), "Expected no PasswordMessage for %s", name)
+		}
+	})
+
+	t.Run("SCRAM", func(t *testing.T) {
+		c := scramClient{password: "secret"}
+		mechanism, response, err := c.initial([]string{scramSHA256, scramSHA256Plus})
+		require.NoError(t, err)
+		assert.Equal(t, scramSHA256, mechanism)
+		assert.True(t, strings.HasPrefix(string(response), "n,,n=,r="), "got %q", response)
+
+		c = scramClient{password: "secret", binding: []byte{1, 2, 3}}
+		mechanism, response, err = c.initial([]string{scramSHA256})
+		require.NoError(t, err)
+		assert.Equal(t, scramSHA256, mechanism)
+		assert.True(t, strings.HasPrefix(string(response), "y,,"), "got %q", response)
+
+		mechanism, response, err = c.initial([]string{scramSHA256, scramSHA256Plus})
+		require.NoError(t, err)
+		assert.Equal(t, scramSHA256Plus, mechanism)
+		assert.True(t, strings.HasPrefix(string(response), "p=tls-server-end-point,,"), "got %q", response)
+
+		final, err := c.final([]byte("r=" + c.nonce + "server,s=c2FsdA==,i=4096"))
+		require.NoError(t, err)
+		binding := base64.StdEncoding.EncodeToString([]byte("p=tls-server-end-point,,\x01\x02\x03"))
+		assert.True(t, strings.HasPrefix(string(final), "c="+binding+",r="), "got %q", final)
+
+		_, err = c.final([]byte("r=other,s=c2FsdA==,i=4096"))
+		assert.Error(t, err, "Expected the nonce to be checked")
+	})
+}
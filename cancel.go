@@ -0,0 +1,71 @@
+package pgtwixt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Cancellations issues the keys that frontends use to cancel their queries.
+// Each key routes a CancelRequest to whichever backend is serving that
+// frontend at the time, so keys of backends are never revealed to frontends.
+type Cancellations struct {
+	mu      sync.Mutex
+	cancels map[CancellationKey]func() error
+}
+
+// Issue returns a new random key that calls cancel when it is used.
+func (c *Cancellations) Issue(cancel func() error) (CancellationKey, error) {
+	var b [8]byte
+	var k CancellationKey
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancels == nil {
+		c.cancels = make(map[CancellationKey]func() error)
+	}
+
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return k, err
+		}
+
+		k.id = binary.BigEndian.Uint32(b[:4])
+		k.secret = binary.BigEndian.Uint32(b[4:])
+
+		if _, ok := c.cancels[k]; !ok {
+			c.cancels[k] = cancel
+			return k, nil
+		}
+	}
+}
+
+// Revoke forgets a key when its frontend disconnects.
+func (c *Cancellations) Revoke(k CancellationKey) {
+	c.mu.Lock()
+	delete(c.cancels, k)
+	c.mu.Unlock()
+}
+
+// Cancel calls the function issued with key.
+func (c *Cancellations) Cancel(k CancellationKey) error {
+	c.mu.Lock()
+	cancel, ok := c.cancels[k]
+	c.mu.Unlock()
+
+	if !ok {
+		return errors.New("unknown cancellation key")
+	}
+	return cancel()
+}
+
+// cancelBackend sends a CancelRequest for key through the dialer that opened
+// its backend.
+func cancelBackend(d Dialer, k CancellationKey) error {
+	if d == nil {
+		return errors.New("backend does not accept cancellation")
+	}
+	return Connector{Dialer: d}.Cancel(k)
+}
@@ -0,0 +1,57 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// cancelDialer collects the messages sent through it.
+type cancelDialer struct{ buf bytes.Buffer }
+
+func (*cancelDialer) Addr() string { return "cancel" }
+
+func (d *cancelDialer) Dial(context.Context) (BackendStream, error) {
+	return BackendStream{
+		debug:  func(...interface{}) error { return nil },
+		stream: core.NewBackendStream(nopCloser{&d.buf}),
+	}, nil
+}
+
+func (d *cancelDialer) key(t *testing.T) CancellationKey {
+	var msg core.Message
+	require.NoError(t, core.NewFrontendStream(nopCloser{&d.buf}).Next(&msg))
+
+	c, err := proto.ReadCancelRequest(&msg)
+	require.NoError(t, err)
+	return CancellationKey{id: c.BackendPid, secret: c.SecretKey}
+}
+
+func TestCancellations(t *testing.T) {
+	t.Parallel()
+
+	var c Cancellations
+	var called int
+
+	k1, err := c.Issue(func() error { called++; return nil })
+	require.NoError(t, err)
+	k2, err := c.Issue(func() error { return errors.New("two") })
+	require.NoError(t, err)
+	assert.NotEqual(t, k1, k2)
+
+	assert.NoError(t, c.Cancel(k1))
+	assert.Equal(t, 1, called)
+	assert.EqualError(t, c.Cancel(k2), "two")
+
+	c.Revoke(k1)
+	assert.Error(t, c.Cancel(k1), "Expected revoked key to be unknown")
+	assert.Equal(t, 1, called)
+
+	assert.Error(t, c.Cancel(CancellationKey{id: 1, secret: 2}), "Expected unknown key to fail")
+}
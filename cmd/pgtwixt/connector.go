@@ -4,6 +4,9 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/cbandy/pgtwixt"
@@ -11,6 +14,60 @@ import (
 
 type Connector struct {
 	Debug pgtwixt.LogFunc
+
+	// SSLFiles holds the client certificate, root certificates, and CRL of
+	// every TCP dialer, see LoadSSLFiles.
+	SSLFiles *pgtwixt.TLSFiles
+}
+
+// LoadSSLFiles loads the sslcert, sslkey, sslrootcert, and sslcrl of cs. Each
+// defaults to a file in ~/.postgresql when that file exists, and
+// sslrootcert=system uses the certificate authorities of the system. It
+// returns nil when there are no files or sslmode is "disable".
+func (c Connector) LoadSSLFiles(cs pgtwixt.ConnectionString) (*pgtwixt.TLSFiles, error) {
+	if cs.SSLMode == "disable" {
+		return nil, nil
+	}
+
+	home, _ := os.UserHomeDir()
+	path := func(explicit, name string) string {
+		if explicit != "" || home == "" {
+			return explicit
+		}
+		p := filepath.Join(home, ".postgresql", name)
+		if _, err := os.Stat(p); err != nil {
+			return ""
+		}
+		return p
+	}
+
+	files := &pgtwixt.TLSFiles{
+		CertFile: path(cs.SSLCertPath, "postgresql.crt"),
+	}
+	if files.CertFile != "" {
+		files.KeyFile = path(cs.SSLKeyPath, "postgresql.key")
+	}
+	if cs.SSLCAPath != "system" {
+		files.CAFile = path(cs.SSLCAPath, "root.crt")
+
+		if files.CAFile == "" && (cs.SSLMode == "verify-ca" || cs.SSLMode == "verify-full") {
+			return nil, fmt.Errorf("root certificate file %q does not exist; "+
+				"either provide the file or use sslrootcert=system", filepath.Join(home, ".postgresql", "root.crt"))
+		}
+	}
+
+	// The revocation list is verified by the certificate authorities of the
+	// root certificate file, so libpq reads it only along with that file.
+	if files.CAFile != "" {
+		files.CRLFile = path(cs.SSLCRLPath, "root.crl")
+	} else if cs.SSLCRLPath != "" {
+		return nil, fmt.Errorf("sslcrl %q requires an sslrootcert file", cs.SSLCRLPath)
+	}
+
+	if files.CertFile == "" && files.KeyFile == "" && files.CAFile == "" && files.CRLFile == "" {
+		return nil, nil
+	}
+	return files, files.Load()
 }
 
 func (c Connector) Dialers(cs pgtwixt.ConnectionString) ([]pgtwixt.Dialer, error) {
@@ -24,8 +81,10 @@ func (c Connector) Dialers(cs pgtwixt.ConnectionString) ([]pgtwixt.Dialer, error
 		return nil, fmt.Errorf("address and port lengths do not match: %v versus %v", cs.HostAddr, cs.Port)
 	}
 
+	// Environment supplies the default host and port of a connection string
+	// without any. These remain for empty entries, e.g. "host=a,,b".
 	get := func(ss []string, i int, d string) string {
-		if len(ss) > i {
+		if len(ss) > i && ss[i] != "" {
 			return ss[i]
 		}
 		return d
@@ -36,7 +95,10 @@ func (c Connector) Dialers(cs pgtwixt.ConnectionString) ([]pgtwixt.Dialer, error
 
 	for i, more := 0, true; more && err == nil; more = (i < len(cs.Host) || i < len(cs.HostAddr)) {
 		ds = append(ds, nil)
-		port := get(cs.Port, i, get(cs.Port, 0, "5432"))
+		port := get(cs.Port, 0, pgtwixt.DefaultPort)
+		if len(cs.Port) > 1 {
+			port = get(cs.Port, i, pgtwixt.DefaultPort)
+		}
 
 		if len(cs.HostAddr) > i || (len(cs.Host) > i && !strings.HasPrefix(cs.Host[i], "/")) {
 			host := get(cs.Host, i, "")
@@ -44,7 +106,7 @@ func (c Connector) Dialers(cs pgtwixt.ConnectionString) ([]pgtwixt.Dialer, error
 
 			ds[i], err = c.tcpDialer(host, addr, port, cs)
 		} else {
-			host := get(cs.Host, i, "/tmp")
+			host := get(cs.Host, i, pgtwixt.DefaultHost)
 
 			ds[i], err = c.unixDialer(host, port, cs)
 		}
@@ -61,12 +123,14 @@ func (c Connector) tcpDialer(host, hostaddr, port string, cs pgtwixt.ConnectionS
 
 	if hostaddr != "" {
 		d.Address = net.JoinHostPort(hostaddr, port)
+		d.Host = host
 	} else {
 		d.Address = net.JoinHostPort(host, port)
 	}
 
 	d.SSLMode = cs.SSLMode
-	d.SSLConfig = tls.Config{
+	d.SSLFiles = c.SSLFiles
+	d.SSLConfig = &tls.Config{
 		MinVersion:    tls.VersionTLS12,
 		Renegotiation: tls.RenegotiateFreelyAsClient,
 		ServerName:    host,
@@ -76,6 +140,20 @@ func (c Connector) tcpDialer(host, hostaddr, port string, cs pgtwixt.ConnectionS
 		d.Timeout, err = cs.SecondsDuration(cs.ConnectTimeout)
 	}
 
+	d.KeepAlivesDisable = cs.KeepAlives == "0"
+	if cs.KeepAlivesIdle != "" && err == nil {
+		d.KeepAlivesIdle, err = cs.SecondsDuration(cs.KeepAlivesIdle)
+	}
+	if cs.KeepAlivesInterval != "" && err == nil {
+		d.KeepAlivesInterval, err = cs.SecondsDuration(cs.KeepAlivesInterval)
+	}
+	if cs.KeepAlivesCount != "" && err == nil {
+		d.KeepAlivesCount, err = strconv.Atoi(cs.KeepAlivesCount)
+	}
+	if cs.TCPUserTimeout != "" && err == nil {
+		d.UserTimeout, err = cs.MillisecondsDuration(cs.TCPUserTimeout)
+	}
+
 	return d, err
 }
 
@@ -92,3 +170,88 @@ func (c Connector) unixDialer(host, port string, cs pgtwixt.ConnectionString) (p
 
 	return d, err
 }
+
+// sysconfdir is the directory of pg_service.conf when PGSYSCONFDIR is not set.
+// It is the default of PostgreSQL built from source; packages that use another,
+// such as /etc/postgresql-common, can set it with -ldflags "-X main.sysconfdir=".
+var sysconfdir = "/usr/local/pgsql/etc"
+
+// Service merges the settings of the service of cs or PGSERVICE beneath those
+// of cs. The service is looked up in PGSERVICEFILE or ~/.pg_service.conf and
+// then in pg_service.conf of PGSYSCONFDIR or sysconfdir.
+func (c Connector) Service(cs pgtwixt.ConnectionString) (pgtwixt.ConnectionString, error) {
+	if cs.Service == "" {
+		cs.Service = os.Getenv("PGSERVICE")
+	}
+	if cs.Service == "" {
+		return cs, nil
+	}
+
+	var paths []string
+	if path := os.Getenv("PGSERVICEFILE"); path != "" {
+		paths = append(paths, path)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "pg_service.conf"))
+	} else {
+		paths = append(paths, filepath.Join(sysconfdir, "pg_service.conf"))
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return cs, err
+		}
+
+		services, err := pgtwixt.ReadServiceFile(f)
+		_ = f.Close()
+		if err != nil {
+			return cs, fmt.Errorf("%s: %v", path, err)
+		}
+
+		if defaults, ok := services.ConnectionString(cs.Service); ok {
+			cs.Merge(defaults)
+			return cs, nil
+		}
+	}
+
+	return cs, fmt.Errorf("definition of service %q not found", cs.Service)
+}
+
+// Passfile reads the passfile of cs or ~/.pgpass. The default file is ignored
+// when it does not exist or others can read it.
+func (c Connector) Passfile(cs pgtwixt.ConnectionString) (pgtwixt.Passfile, error) {
+	path := cs.PasswordPath
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".pgpass")
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && cs.PasswordPath == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		c.Debug("msg", "Ignoring password file with group or world access", "path", path)
+		return nil, nil
+	}
+
+	return pgtwixt.ReadPassfile(f)
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -34,7 +38,7 @@ func TestDialersTCP(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "example.com:5432",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 				ServerName:    "example.com",
@@ -51,13 +55,32 @@ func TestDialersTCP(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "127.0.0.1:5432",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
 		}, ds[0])
 	})
 
+	t.Run("HostAndHostAddr", func(t *testing.T) {
+		ds, err := Connector{}.Dialers(pgtwixt.ConnectionString{
+			Host:     []string{"example.com"},
+			HostAddr: []string{"127.0.0.1"},
+		})
+		require.NoError(t, err)
+		require.Len(t, ds, 1)
+
+		assert.Equal(t, pgtwixt.TCPDialer{
+			Address: "127.0.0.1:5432",
+			Host:    "example.com",
+			SSLConfig: &tls.Config{
+				MinVersion:    tls.VersionTLS12,
+				Renegotiation: tls.RenegotiateFreelyAsClient,
+				ServerName:    "example.com",
+			},
+		}, ds[0])
+	})
+
 	t.Run("HostPort", func(t *testing.T) {
 		ds, err := Connector{}.Dialers(pgtwixt.ConnectionString{
 			Host: []string{"example.com"},
@@ -68,7 +91,7 @@ func TestDialersTCP(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "example.com:888",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 				ServerName:    "example.com",
@@ -76,6 +99,18 @@ func TestDialersTCP(t *testing.T) {
 		}, ds[0])
 	})
 
+	t.Run("HostPortEmpty", func(t *testing.T) {
+		ds, err := Connector{}.Dialers(pgtwixt.ConnectionString{
+			Host: []string{"example.com", "example.org"},
+			Port: []string{"888", ""},
+		})
+		require.NoError(t, err)
+		require.Len(t, ds, 2)
+
+		assert.Equal(t, "example.com:888", ds[0].Addr())
+		assert.Equal(t, "example.org:5432", ds[1].Addr(), "Expected the default port")
+	})
+
 	t.Run("HostAddrPort", func(t *testing.T) {
 		ds, err := Connector{}.Dialers(pgtwixt.ConnectionString{
 			HostAddr: []string{"127.0.0.1"},
@@ -86,14 +121,44 @@ func TestDialersTCP(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "127.0.0.1:99",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
 		}, ds[0])
 	})
 
-	// TODO keepalives
+	t.Run("KeepAlives", func(t *testing.T) {
+		ds, err := Connector{}.Dialers(pgtwixt.ConnectionString{
+			Host:               []string{"example.com"},
+			KeepAlivesIdle:     "60",
+			KeepAlivesInterval: "5",
+			KeepAlivesCount:    "3",
+			TCPUserTimeout:     "30000",
+		})
+		require.NoError(t, err)
+		require.Len(t, ds, 1)
+
+		assert.Equal(t, pgtwixt.TCPDialer{
+			Address: "example.com:5432",
+			SSLConfig: &tls.Config{
+				MinVersion:    tls.VersionTLS12,
+				Renegotiation: tls.RenegotiateFreelyAsClient,
+				ServerName:    "example.com",
+			},
+			KeepAlivesCount:    3,
+			KeepAlivesIdle:     time.Minute,
+			KeepAlivesInterval: 5 * time.Second,
+			UserTimeout:        30 * time.Second,
+		}, ds[0])
+
+		ds, err = Connector{}.Dialers(pgtwixt.ConnectionString{
+			Host:       []string{"example.com"},
+			KeepAlives: "0",
+		})
+		require.NoError(t, err)
+		assert.True(t, ds[0].(pgtwixt.TCPDialer).KeepAlivesDisable)
+	})
 
 	t.Run("SSL", func(t *testing.T) {
 		t.Run("Mode", func(t *testing.T) {
@@ -107,7 +172,7 @@ func TestDialersTCP(t *testing.T) {
 			assert.Equal(t, pgtwixt.TCPDialer{
 				Address: "example.com:5432",
 				SSLMode: "something",
-				SSLConfig: tls.Config{
+				SSLConfig: &tls.Config{
 					MinVersion:    tls.VersionTLS12,
 					Renegotiation: tls.RenegotiateFreelyAsClient,
 					ServerName:    "example.com",
@@ -123,24 +188,91 @@ func TestDialersTCP(t *testing.T) {
 			// TODO reject
 		})
 
+		dir, err := ioutil.TempDir("", "pgtwixt")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		certFile, keyFile := writeTestCert(t, dir, "client")
+
 		t.Run("Cert+Key", func(t *testing.T) {
-			// TODO
-			// - create temporary files containing certificate and key
-			// - set the paths in connection string
-			// - # tls.LoadX509KeyPair()
-			// - assert d.SSLConfig.Certificates
+			files, err := Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLCertPath: certFile,
+				SSLKeyPath:  keyFile,
+			})
+			require.NoError(t, err)
+			require.NotNil(t, files)
+
+			ds, err := Connector{SSLFiles: files}.Dialers(pgtwixt.ConnectionString{
+				Host: []string{"example.com"},
+			})
+			require.NoError(t, err)
+			require.Len(t, ds, 1)
+			assert.Equal(t, files, ds[0].(pgtwixt.TCPDialer).SSLFiles)
+
+			cert, err := files.GetClientCertificate(nil)
+			require.NoError(t, err)
+			assert.Len(t, cert.Certificate, 1)
 		})
 
 		t.Run("CA", func(t *testing.T) {
-			// TODO
-			// - create a temporary file containing certificate
-			// - set the path in connection string
-			// - # x509.NewCertPool()
-			// - assert d.SSLConfig.RootCAs.Subjects()
+			files, err := Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLMode:   "verify-full",
+				SSLCAPath: certFile,
+			})
+			require.NoError(t, err)
+			require.NotNil(t, files)
+			require.NotNil(t, files.CertPool())
+
+			files, err = Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLMode:   "verify-full",
+				SSLCAPath: "system",
+			})
+			assert.NoError(t, err)
+			assert.Nil(t, files, "Expected system roots")
+
+			_, err = Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLCAPath: filepath.Join(dir, "missing.crt"),
+			})
+			assert.Error(t, err)
 		})
 
 		t.Run("CRL", func(t *testing.T) {
-			// TODO reject
+			crlFile := writeTestCRL(t, certFile, keyFile)
+
+			files, err := Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLCAPath:  certFile,
+				SSLCRLPath: crlFile,
+			})
+			require.NoError(t, err)
+			require.NotNil(t, files)
+
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			require.NoError(t, err)
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			require.NoError(t, err)
+			assert.True(t, files.Revoked(leaf))
+
+			_, err = Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLCAPath:  certFile,
+				SSLCRLPath: keyFile,
+			})
+			assert.Error(t, err)
+
+			_, err = Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLCAPath:  "system",
+				SSLCRLPath: crlFile,
+			})
+			assert.Error(t, err, "Expected a root certificate file to verify the list")
+		})
+
+		t.Run("Disable", func(t *testing.T) {
+			files, err := Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{
+				SSLMode:     "disable",
+				SSLCertPath: certFile,
+				SSLKeyPath:  keyFile,
+			})
+			assert.NoError(t, err)
+			assert.Nil(t, files)
 		})
 	})
 
@@ -154,7 +286,7 @@ func TestDialersTCP(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "example.com:5432",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 				ServerName:    "example.com",
@@ -174,6 +306,19 @@ func TestDialersTCPError(t *testing.T) {
 		})
 		assert.Error(t, err)
 	})
+
+	t.Run("KeepAlives", func(t *testing.T) {
+		for _, cs := range []pgtwixt.ConnectionString{
+			{KeepAlivesIdle: "nope"},
+			{KeepAlivesInterval: "nope"},
+			{KeepAlivesCount: "nope"},
+			{TCPUserTimeout: "nope"},
+		} {
+			cs.Host = []string{"example.com"}
+			_, err := Connector{}.Dialers(cs)
+			assert.Error(t, err, "%+v", cs)
+		}
+	})
 }
 
 func TestDialersUnix(t *testing.T) {
@@ -228,6 +373,19 @@ func TestDialersUnixError(t *testing.T) {
 		})
 		assert.Error(t, err)
 	})
+
+	t.Run("KeepAlives", func(t *testing.T) {
+		for _, cs := range []pgtwixt.ConnectionString{
+			{KeepAlivesIdle: "nope"},
+			{KeepAlivesInterval: "nope"},
+			{KeepAlivesCount: "nope"},
+			{TCPUserTimeout: "nope"},
+		} {
+			cs.Host = []string{"example.com"}
+			_, err := Connector{}.Dialers(cs)
+			assert.Error(t, err, "%+v", cs)
+		}
+	})
 }
 
 func TestDialersMultipleError(t *testing.T) {
@@ -298,7 +456,7 @@ func TestDialersMultipleHost(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "example.com:5432",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 				ServerName:    "example.com",
@@ -319,7 +477,7 @@ func TestDialersMultipleHost(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "example.com:1000",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 				ServerName:    "example.com",
@@ -340,7 +498,7 @@ func TestDialersMultipleHost(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "example.com:1000",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 				ServerName:    "example.com",
@@ -364,14 +522,14 @@ func TestDialersMultipleHostAddr(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "127.0.0.1:5432",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
 		}, ds[0])
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "[::1]:5432",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
@@ -388,14 +546,14 @@ func TestDialersMultipleHostAddr(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "127.0.0.1:1000",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
 		}, ds[0])
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "[::1]:1000",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
@@ -412,17 +570,154 @@ func TestDialersMultipleHostAddr(t *testing.T) {
 
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "127.0.0.1:1000",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
 		}, ds[0])
 		assert.Equal(t, pgtwixt.TCPDialer{
 			Address: "[::1]:2000",
-			SSLConfig: tls.Config{
+			SSLConfig: &tls.Config{
 				MinVersion:    tls.VersionTLS12,
 				Renegotiation: tls.RenegotiateFreelyAsClient,
 			},
 		}, ds[1])
 	})
 }
+
+func TestPassfile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pgpass")
+	require.NoError(t, ioutil.WriteFile(path, []byte("*:*:*:mary:secret\n"), 0600))
+
+	c := Connector{Debug: func(...interface{}) error { return nil }}
+	p, err := c.Passfile(pgtwixt.ConnectionString{PasswordPath: path})
+	require.NoError(t, err)
+	assert.Equal(t, pgtwixt.Passfile{{"*", "*", "*", "mary", "secret"}}, p)
+
+	t.Run("Permissions", func(t *testing.T) {
+		require.NoError(t, os.Chmod(path, 0644))
+
+		p, err := c.Passfile(pgtwixt.ConnectionString{PasswordPath: path})
+		assert.NoError(t, err)
+		assert.Nil(t, p, "Expected a readable file to be ignored")
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := c.Passfile(pgtwixt.ConnectionString{PasswordPath: filepath.Join(dir, "missing")})
+		assert.Error(t, err)
+	})
+}
+
+// TestLoadSSLFilesDefaults changes HOME, so it cannot run in parallel.
+func TestLoadSSLFilesDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	require.NoError(t, os.Setenv("HOME", dir))
+
+	files, err := Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{})
+	assert.NoError(t, err)
+	assert.Nil(t, files, "Expected no files")
+
+	_, err = Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{SSLMode: "verify-full"})
+	assert.Error(t, err, "Expected verify-full to need root.crt")
+
+	ssl := filepath.Join(dir, ".postgresql")
+	require.NoError(t, os.Mkdir(ssl, 0700))
+	certFile, keyFile := writeTestCert(t, ssl, "postgresql")
+	crlFile := writeTestCRL(t, certFile, keyFile)
+	require.NoError(t, os.Rename(certFile, filepath.Join(ssl, "root.crt")))
+	require.NoError(t, os.Rename(crlFile, filepath.Join(ssl, "root.crl")))
+	certFile, keyFile = writeTestCert(t, ssl, "postgresql")
+
+	files, err = Connector{}.LoadSSLFiles(pgtwixt.ConnectionString{SSLMode: "verify-full"})
+	require.NoError(t, err)
+	require.NotNil(t, files)
+	assert.Equal(t, certFile, files.CertFile)
+	assert.Equal(t, keyFile, files.KeyFile)
+	assert.Equal(t, filepath.Join(ssl, "root.crt"), files.CAFile)
+	assert.Equal(t, filepath.Join(ssl, "root.crl"), files.CRLFile)
+}
+
+// TestService changes the environment, so it cannot run in parallel.
+func TestService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"HOME", "PGSERVICE", "PGSERVICEFILE", "PGSYSCONFDIR"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	require.NoError(t, os.Setenv("HOME", dir))
+	require.NoError(t, os.Unsetenv("PGSERVICE"))
+	require.NoError(t, os.Unsetenv("PGSERVICEFILE"))
+	require.NoError(t, os.Setenv("PGSYSCONFDIR", filepath.Join(dir, "etc")))
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "etc"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".pg_service.conf"),
+		[]byte("[user]\nhost=userhost\nport=5433\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "etc", "pg_service.conf"),
+		[]byte("[user]\nhost=ignored\n[system]\nhost=systemhost\ndbname=db\n"), 0600))
+
+	cs, err := Connector{}.Service(pgtwixt.ConnectionString{Service: "user", Port: []string{"6543"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"userhost"}, cs.Host)
+	assert.Equal(t, []string{"6543"}, cs.Port, "Expected explicit settings to win")
+
+	cs, err = Connector{}.Service(pgtwixt.ConnectionString{Service: "system"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"systemhost"}, cs.Host)
+	assert.Equal(t, "db", cs.Database)
+
+	_, err = Connector{}.Service(pgtwixt.ConnectionString{Service: "missing"})
+	assert.Error(t, err)
+
+	t.Run("PGSERVICEFILE", func(t *testing.T) {
+		path := filepath.Join(dir, "services")
+		require.NoError(t, ioutil.WriteFile(path, []byte("[user]\nhost=filehost\n"), 0600))
+		require.NoError(t, os.Setenv("PGSERVICEFILE", path))
+		defer os.Unsetenv("PGSERVICEFILE")
+
+		cs, err := Connector{}.Service(pgtwixt.ConnectionString{Service: "user"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"filehost"}, cs.Host)
+	})
+
+	t.Run("PGSERVICE", func(t *testing.T) {
+		require.NoError(t, os.Setenv("PGSERVICE", "system"))
+		defer os.Unsetenv("PGSERVICE")
+
+		cs, err := Connector{}.Service(pgtwixt.ConnectionString{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"systemhost"}, cs.Host)
+
+		cs, err = Connector{}.Service(pgtwixt.ConnectionString{Service: "user"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"userhost"}, cs.Host, "Expected the explicit service to win")
+	})
+
+	t.Run("SYSCONFDIR", func(t *testing.T) {
+		require.NoError(t, os.Unsetenv("PGSYSCONFDIR"))
+		defer os.Setenv("PGSYSCONFDIR", filepath.Join(dir, "etc"))
+		defer func(previous string) { sysconfdir = previous }(sysconfdir)
+		sysconfdir = filepath.Join(dir, "etc")
+
+		cs, err := Connector{}.Service(pgtwixt.ConnectionString{Service: "system"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"systemhost"}, cs.Host)
+	})
+
+	t.Run("None", func(t *testing.T) {
+		cs, err := Connector{}.Service(pgtwixt.ConnectionString{User: "x"})
+		assert.NoError(t, err)
+		assert.Equal(t, pgtwixt.ConnectionString{User: "x"}, cs)
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cbandy/pgtwixt"
+)
+
+// Listen is an address on which to accept frontends along with the TLS
+// settings of those frontends and the backends to which they connect.
+type Listen struct {
+	Address    string // "host:port" or the directory of a Unix socket
+	Port       string // in the name of a Unix socket
+	Target     string // connection string of the backends
+	TLS        ServerTLS
+	TLSRequire bool
+
+	ProxyProtocol string // "", "accept", or "require" a PROXY protocol header
+}
+
+// Parse sets the fields of l from keyword=value pairs in the syntax of a
+// connection string, e.g. "address=:6433 target='host=db2' tls_require=1".
+// Keywords that are absent leave their fields unchanged.
+func (l *Listen) Parse(s string) error {
+	return pgtwixt.Grammar{Value: func(key, value string) error {
+		var err error
+		switch key {
+		case "address":
+			l.Address = value
+		case "port":
+			l.Port = value
+		case "target":
+			l.Target = value
+		case "tls_cert":
+			l.TLS.CertFile = value
+		case "tls_key":
+			l.TLS.KeyFile = value
+		case "tls_client_ca":
+			l.TLS.ClientCAFile = value
+		case "tls_client_cert":
+			l.TLS.ClientCert = value
+		case "tls_min_version":
+			l.TLS.MinVersion = value
+		case "tls_ciphers":
+			l.TLS.CipherSuites = value
+		case "tls_require":
+			l.TLSRequire, err = strconv.ParseBool(value)
+		case "proxy_protocol":
+			l.ProxyProtocol = value
+		default:
+			err = fmt.Errorf("unknown keyword")
+		}
+		return err
+	}}.Parse(s)
+}
+
+// Proxy returns the ProxyProtocol and ProxyRequired settings of a Server.
+func (l Listen) Proxy() (bool, bool, error) {
+	switch l.ProxyProtocol {
+	case "":
+		return false, false, nil
+	case "accept":
+		return true, false, nil
+	case "require":
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("unknown PROXY protocol mode: %q", l.ProxyProtocol)
+}
+
+// Unix reports whether Address is the directory of a Unix socket.
+func (l Listen) Unix() bool { return strings.HasPrefix(l.Address, "/") }
+
+// Listen opens the address of l or adopts the first of passed, listeners from
+// a running process, that is on the same address. The adopted listener is
+// removed from passed. The settings of socket other than its directory and
+// port apply to a Unix socket.
+func (l Listen) Listen(passed []net.Listener, socket UnixSocket) (net.Listener, error) {
+	if l.Unix() {
+		socket.Dir, socket.Port = l.Address, l.Port
+	}
+
+	for i := range passed {
+		if passed[i] != nil && l.matches(passed[i].Addr()) {
+			adopted := passed[i]
+			passed[i] = nil
+
+			if l.Unix() {
+				return socket.Adopt(adopted)
+			}
+			return adopted, nil
+		}
+	}
+
+	if l.Unix() {
+		return socket.Listen()
+	}
+	return net.Listen("tcp", l.Address)
+}
+
+// matches reports whether addr is the address of l. An unspecified host or a
+// zero port of l matches any.
+func (l Listen) matches(addr net.Addr) bool {
+	if l.Unix() {
+		socket := UnixSocket{Dir: l.Address, Port: l.Port}
+		return addr.Network() == "unix" && addr.String() == socket.path()
+	}
+
+	passed, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	configured, err := net.ResolveTCPAddr("tcp", l.Address)
+	if err != nil {
+		return false
+	}
+	if configured.Port != 0 && configured.Port != passed.Port {
+		return false
+	}
+	if configured.IP == nil || configured.IP.IsUnspecified() {
+		return passed.IP.IsUnspecified()
+	}
+	return configured.IP.Equal(passed.IP)
+}
+
+// listens collects each -listen flag.
+type listens []string
+
+func (ls *listens) String() string { return strings.Join(*ls, "; ") }
+
+func (ls *listens) Set(s string) error {
+	*ls = append(*ls, s)
+	return nil
+}
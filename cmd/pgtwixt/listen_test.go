@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenParse(t *testing.T) {
+	t.Parallel()
+
+	l := Listen{Target: "host=old", TLS: ServerTLS{CertFile: "a.crt", KeyFile: "a.key", MinVersion: "1.2"}}
+	require.NoError(t, l.Parse(`address=:6433 target='host=new port=5433' tls_cert=b.crt tls_key=b.key tls_require=1`))
+	assert.Equal(t, Listen{
+		Address:    ":6433",
+		Target:     "host=new port=5433",
+		TLS:        ServerTLS{CertFile: "b.crt", KeyFile: "b.key", MinVersion: "1.2"},
+		TLSRequire: true,
+	}, l)
+	assert.False(t, l.Unix())
+
+	l = Listen{}
+	require.NoError(t, l.Parse(`address=/var/run/pgtwixt port=6432 tls_client_ca=ca.crt tls_client_cert=verify-ca tls_min_version=1.3 tls_ciphers=x`))
+	assert.Equal(t, Listen{
+		Address: "/var/run/pgtwixt",
+		Port:    "6432",
+		TLS:     ServerTLS{ClientCAFile: "ca.crt", ClientCert: "verify-ca", MinVersion: "1.3", CipherSuites: "x"},
+	}, l)
+	assert.True(t, l.Unix())
+
+	require.NoError(t, l.Parse(`proxy_protocol=require`))
+	proxied, required, err := l.Proxy()
+	require.NoError(t, err)
+	assert.True(t, proxied)
+	assert.True(t, required)
+
+	l.ProxyProtocol = "maybe"
+	_, _, err = l.Proxy()
+	assert.Error(t, err)
+
+	assert.EqualError(t, l.Parse(`address=:1 bogus=2`), `at offset 11 near "bogus=2", key "bogus": unknown keyword`)
+	assert.Error(t, l.Parse(`tls_require=maybe`))
+}
+
+func TestListenListen(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("TCP", func(t *testing.T) {
+		l, err := Listen{Address: "127.0.0.1:"}.Listen(nil, UnixSocket{})
+		require.NoError(t, err)
+		defer l.Close()
+		assert.Equal(t, "tcp", l.Addr().Network())
+
+		passed := []net.Listener{l}
+		again, err := Listen{Address: l.Addr().String()}.Listen(passed, UnixSocket{})
+		require.NoError(t, err)
+		assert.True(t, l == again, "Expected the passed listener")
+		assert.Nil(t, passed[0], "Expected the passed listener to be taken")
+
+		// After a change of configuration, another address is opened and the
+		// passed listener is left for the caller to close.
+		passed = []net.Listener{l}
+		other, err := Listen{Address: "127.0.0.2:"}.Listen(passed, UnixSocket{})
+		require.NoError(t, err)
+		defer other.Close()
+		assert.True(t, l != other, "Expected a new listener")
+		assert.True(t, l == passed[0])
+	})
+
+	t.Run("Matches", func(t *testing.T) {
+		for _, tt := range []struct {
+			address string
+			addr    net.Addr
+			match   bool
+		}{
+			{":5432", &net.TCPAddr{IP: net.IPv6unspecified, Port: 5432}, true},
+			{":5432", &net.TCPAddr{IP: net.IPv6unspecified, Port: 5433}, false},
+			{":5432", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432}, false},
+			{"127.0.0.1:5432", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432}, true},
+			{"127.0.0.1:5432", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5432}, false},
+			{"127.0.0.1:", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, true},
+			{":5432", &net.UnixAddr{Name: filepath.Join(dir, ".s.PGSQL.5432"), Net: "unix"}, false},
+			{dir, &net.UnixAddr{Name: filepath.Join(dir, ".s.PGSQL.6432"), Net: "unix"}, true},
+			{dir, &net.UnixAddr{Name: filepath.Join(dir, ".s.PGSQL.5432"), Net: "unix"}, false},
+			{dir, &net.TCPAddr{IP: net.IPv6unspecified, Port: 6432}, false},
+		} {
+			assert.Equal(t, tt.match, Listen{Address: tt.address, Port: "6432"}.matches(tt.addr),
+				"%q %v", tt.address, tt.addr)
+		}
+	})
+
+	t.Run("Unix", func(t *testing.T) {
+		l, err := Listen{Address: dir, Port: "6432"}.Listen(nil, UnixSocket{Permissions: "0700"})
+		require.NoError(t, err)
+		defer l.Close()
+
+		info, err := os.Stat(filepath.Join(dir, ".s.PGSQL.6432"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+		conn, err := net.Dial("unix", filepath.Join(dir, ".s.PGSQL.6432"))
+		require.NoError(t, err)
+		conn.Close()
+	})
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cbandy/pgtwixt"
@@ -15,16 +21,111 @@ import (
 )
 
 func main() {
+	authFile := flag.String("auth-file", "", `authenticate frontends against lines of "user" "secret" in this file`)
+	authMethod := flag.String("auth-method", "scram-sha-256", `authenticate frontends using "scram-sha-256", "md5", or "password"`)
+	var serverTLS ServerTLS
+	var extra listens
+	flag.Var(&extra, "listen", "also accept frontends on a listener described by keyword=value pairs: "+
+		"address, port, target, tls_cert, tls_key, tls_client_ca, tls_client_cert, tls_min_version, tls_ciphers, tls_require, and proxy_protocol; "+
+		"absent keywords are those of the arguments and flags")
+	flag.StringVar(&serverTLS.CertFile, "tls-cert", "", "certificate file of the listener")
+	flag.StringVar(&serverTLS.KeyFile, "tls-key", "", "private key file of the listener")
+	flag.StringVar(&serverTLS.ClientCAFile, "tls-client-ca", "", "file of certificate authorities that sign client certificates")
+	flag.StringVar(&serverTLS.ClientCert, "tls-client-cert", "", `require client certificates: "verify-ca" or "verify-full" to match the common name to the user`)
+	flag.StringVar(&serverTLS.MinVersion, "tls-min-version", "1.2", "minimum TLS version of the listener")
+	flag.StringVar(&serverTLS.CipherSuites, "tls-ciphers", "", "comma-separated cipher suites of the listener")
+	tlsRequire := flag.Bool("tls-require", false, "disconnect frontends that do not use TLS, except those on the Unix socket")
+	var unixSocket UnixSocket
+	flag.StringVar(&unixSocket.Dir, "unix-socket-dir", "", "directory in which to also listen on a Unix socket named like PostgreSQL: .s.PGSQL.<port>")
+	flag.StringVar(&unixSocket.Port, "unix-socket-port", "", "port in the name of the Unix socket, default is the port of the listener")
+	flag.StringVar(&unixSocket.Permissions, "unix-socket-permissions", "0777", "octal permissions of the Unix socket")
+	flag.StringVar(&unixSocket.Group, "unix-socket-group", "", "owning group of the Unix socket")
+	peerAuth := flag.Bool("peer-auth", false, "require the system user of Unix socket frontends to match their user, in place of -auth-file")
+	proxyProtocol := flag.String("proxy-protocol", "", `read a PROXY protocol header from TCP frontends: "accept" or "require"`)
+	proxyTrusted := flag.String("proxy-trusted", "", "comma-separated CIDRs of proxies that may send a PROXY protocol header, required with -proxy-protocol")
+	keepAlivesIdle := flag.Duration("keepalives-idle", 0, "idle time before TCP keepalives to frontends, zero is 15s")
+	keepAlivesInterval := flag.Duration("keepalives-interval", 0, "time between TCP keepalives to frontends, zero is 15s")
+	keepAlivesCount := flag.Int("keepalives-count", 0, "TCP keepalives to frontends that can be lost, zero is the system default")
+	tcpUserTimeout := flag.Duration("tcp-user-timeout", 0, "time data to frontends can remain unacknowledged, zero is the system default")
+	loginTimeout := flag.Duration("login-timeout", time.Minute, "time frontends have to negotiate TLS, send startup, and authenticate, zero is unlimited")
+	maxClientConn := flag.Int("max-client-conn", 0, "maximum number of frontend connections per listener, zero is unlimited")
+	maxClientConnPerIP := flag.Int("max-client-conn-per-ip", 0, "maximum number of frontend connections per listener from each address, zero is unlimited")
+	upgradeSocket := flag.String("upgrade-socket", "", "Unix socket through which a new process takes over the listeners of a running one")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time for frontends to finish their transactions after SIGINT or SIGTERM")
+	strict := flag.Bool("strict", false, "reject unknown keywords in the connection string")
+	poolMode := flag.String("pool-mode", "", `share backends between frontends: "session" or "transaction"`)
+	poolMinSize := flag.Int("pool-min-size", 0, "number of pooled backends to keep open per startup parameters")
+	poolMaxSize := flag.Int("pool-max-size", 0, "maximum number of pooled backends per startup parameters")
+	poolMaxIdle := flag.Duration("pool-max-idle", 10*time.Minute, "close pooled backends that are idle longer than this")
+	poolMaxLifetime := flag.Duration("pool-max-lifetime", time.Hour, "close pooled backends that are open longer than this")
+	poolReset := flag.String("pool-reset", "DISCARD ALL", "query sent before a backend from a session is reused")
+	flag.Parse()
+
 	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 
-	listen, err := net.Listen("tcp", os.Args[1])
-	if err != nil {
-		panic(err)
+	// The arguments, -unix-socket-dir, and each -listen describe a listener.
+	defaults := Listen{
+		Address: flag.Arg(0), Target: flag.Arg(2),
+		TLS: serverTLS, TLSRequire: *tlsRequire,
+		ProxyProtocol: *proxyProtocol,
+	}
+	config := []Listen{defaults}
+	if unixSocket.Dir != "" {
+		l := defaults
+		l.Address, l.Port = unixSocket.Dir, unixSocket.Port
+		config = append(config, l)
+	}
+	for _, s := range extra {
+		l := defaults
+		l.Address = ""
+		if err := l.Parse(s); err != nil {
+			panic(fmt.Errorf("-listen %q: %w", s, err))
+		}
+		if l.Address == "" {
+			panic(fmt.Errorf("-listen %q: address is required", s))
+		}
+		config = append(config, l)
+	}
+
+	// A new process takes over the listeners of a running one without a gap.
+	// They are matched to the configuration by address.
+	// The running process keeps serving until this one has loaded its
+	// configuration and is about to serve.
+	var passed []net.Listener
+	var err error
+	tookOver := func() error { return nil }
+	if *upgradeSocket != "" {
+		if passed, tookOver, err = takeover(*upgradeSocket); err != nil {
+			panic(err)
+		}
+	}
+
+	listeners := make([]net.Listener, len(config))
+	for i := range config {
+		// A Unix socket without a port is named by that of the first TCP
+		// listener, or 5432.
+		if config[i].Unix() && config[i].Port == "" {
+			config[i].Port = "5432"
+			if i > 0 {
+				if addr, ok := listeners[0].Addr().(*net.TCPAddr); ok {
+					config[i].Port = strconv.Itoa(addr.Port)
+				}
+			}
+		}
+		if listeners[i], err = config[i].Listen(passed, unixSocket); err != nil {
+			panic(err)
+		}
+	}
+	for _, l := range passed {
+		if l != nil {
+			logger.Log("msg", "Closing passed listener that is no longer configured", "address", l.Addr())
+			_ = l.Close()
+		}
 	}
 
 	go func() {
 		metrics := &http.Server{
-			Addr:         os.Args[2],
+			Addr:         flag.Arg(1),
 			ReadTimeout:  4 * time.Second,
 			WriteTimeout: 4 * time.Second,
 			Handler: promhttp.InstrumentMetricHandler(
@@ -34,86 +135,225 @@ func main() {
 			),
 		}
 
-		err := metrics.ListenAndServe()
+		// During an upgrade, the running process holds the address until it
+		// exits.
+		for {
+			err := metrics.ListenAndServe()
+			logger.Log("msg", "Error serving metrics", "error", err)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	// Pooled backends are only shared with frontends that pgtwixt itself
+	// authenticates: by password or by the peer of every Unix socket.
+	authenticated := *authFile != ""
+	if *peerAuth && !authenticated {
+		authenticated = true
+		for _, l := range config {
+			if !l.Unix() {
+				authenticated = false
+			}
+		}
+	}
+
+	routes := &Routes{
+		Info:   logger.Log,
+		Strict: *strict,
+
+		Cancellations: new(pgtwixt.Cancellations),
+
+		Login:    *authFile != "",
+		PoolMode: *poolMode,
+		Pool: func() *pgtwixt.Pool {
+			return &pgtwixt.Pool{
+				MinSize:     *poolMinSize,
+				MaxSize:     *poolMaxSize,
+				MaxIdle:     *poolMaxIdle,
+				MaxLifetime: *poolMaxLifetime,
+				Reset:       *poolReset,
+			}
+		},
+		Authenticated: authenticated,
+	}
+
+	var authenticator *pgtwixt.Authenticator
+	if *authFile != "" {
+		f, err := os.Open(*authFile)
+		if err != nil {
+			panic(err)
+		}
+		credentials, err := pgtwixt.ReadCredentials(f)
+		_ = f.Close()
 		if err != nil {
 			panic(err)
 		}
-	}()
 
-	go func() {
-		signals := make(chan os.Signal)
-		signal.Notify(signals, os.Interrupt)
-		for s := range signals {
-			fmt.Printf("Got signal %v\n", s)
-			os.Exit(1)
+		authenticator = &pgtwixt.Authenticator{Method: *authMethod, Secret: credentials.Secret}
+	}
+
+	var trusted []*net.IPNet
+	for _, cidr := range strings.Split(*proxyTrusted, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				panic(err)
+			}
+			trusted = append(trusted, n)
 		}
-	}()
+	}
 
-	var connstr pgtwixt.ConnectionString
-	err = connstr.Parse(os.Args[3])
-	if err != nil {
-		panic(err)
+	var reloadable []*pgtwixt.TLSFiles
+	servers := make([]*pgtwixt.Server, len(config))
+	for i := range config {
+		proxy, err := routes.Proxy(config[i].Target)
+		if err != nil {
+			panic(err)
+		}
+
+		tlsConfig, tlsFiles, err := config[i].TLS.Config()
+		if err != nil {
+			panic(err)
+		}
+		if tlsFiles != nil {
+			reloadable = append(reloadable, tlsFiles)
+		}
+		if config[i].TLSRequire && tlsConfig == nil {
+			panic(fmt.Errorf("-tls-require requires -tls-cert and -tls-key"))
+		}
+
+		proxied, proxyRequired, err := config[i].Proxy()
+		if err != nil {
+			panic(err)
+		}
+		if proxied && len(trusted) == 0 {
+			panic(fmt.Errorf("-proxy-protocol requires -proxy-trusted"))
+		}
+
+		bind := listeners[i].Addr().String()
+		servers[i] = &pgtwixt.Server{
+			Debug: logger.Log,
+			Info:  logger.Log,
+
+			TLS:        tlsConfig,
+			RequireTLS: config[i].TLSRequire,
+			CertUser:   config[i].TLS.ClientCert == "verify-full",
+			PeerUser:   *peerAuth,
+
+			ProxyProtocol: proxied,
+			ProxyRequired: proxyRequired,
+			ProxyTrusted:  trusted,
+
+			KeepAlivesCount:    *keepAlivesCount,
+			KeepAlivesIdle:     *keepAlivesIdle,
+			KeepAlivesInterval: *keepAlivesInterval,
+			UserTimeout:        *tcpUserTimeout,
+
+			LoginTimeout: *loginTimeout,
+
+			MaxClientConnections:      *maxClientConn,
+			MaxClientConnectionsPerIP: *maxClientConnPerIP,
+
+			Cancel: func(c pgtwixt.CancellationKey) {
+				if err := routes.Cancellations.Cancel(c); err != nil {
+					logger.Log("msg", "Error during cancel", "error", err)
+				}
+			},
+			Session: func(fe pgtwixt.FrontendStream, startup map[string]string) {
+				fmt.Printf("%#v\n", startup)
+				proxy.Run(fe, startup)
+			},
+
+			CountConnect: func() func() {
+				var (
+					connections = metrics.frontend.connections.With(prometheus.Labels{"bind": bind})
+					connects    = metrics.frontend.connects.With(prometheus.Labels{"bind": bind})
+				)
+				return func() { connections.Inc(); connects.Inc() }
+			}(),
+			CountDisconnect: func() func() {
+				var (
+					connections = metrics.frontend.connections.With(prometheus.Labels{"bind": bind})
+					disconnects = metrics.frontend.disconnects.With(prometheus.Labels{"bind": bind})
+				)
+				return func() { connections.Dec(); disconnects.Inc() }
+			}(),
+			CountLoginTimeout: metrics.frontend.loginTimeouts.With(prometheus.Labels{"bind": bind}).Inc,
+		}
+
+		if authenticator != nil {
+			servers[i].Authenticate = authenticator.Authenticate
+		}
 	}
 
-	ds, err := Connector{Debug: logger.Log}.Dialers(connstr)
-	if err != nil {
-		panic(err)
+	// Certificates are reloaded when their files change or on SIGHUP.
+	reloadable = append(reloadable, routes.Reloadable...)
+	for _, files := range reloadable {
+		go files.Watch(context.Background(), 10*time.Second, logger.Log)
 	}
 
-	connector := pgtwixt.Connector{Dialer: ds[0]}
-	proxy := pgtwixt.Proxy{
-		Info: logger.Log,
+	// SIGINT, SIGTERM, and an upgrade drain frontends between transactions
+	// before exiting.
+	stopped := make(chan struct{})
+	var stopping sync.Once
+	stop := func(reason string) {
+		stopping.Do(func() {
+			go func() {
+				logger.Log("msg", "Shutting down", "reason", reason, "timeout", *shutdownTimeout)
+				ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 
-		Startup: connector.Startup,
+				var wg sync.WaitGroup
+				for _, srv := range servers {
+					wg.Add(1)
+					go func(srv *pgtwixt.Server) {
+						defer wg.Done()
+						if err := srv.Shutdown(ctx); err != nil {
+							logger.Log("msg", "Error during shutdown", "error", err)
+						}
+					}(srv)
+				}
+				wg.Wait()
 
-		CountConnect: func() func() {
-			var (
-				connections = metrics.backend.connections.With(prometheus.Labels{"host": connector.Addr()})
-				connects    = metrics.backend.connects.With(prometheus.Labels{"host": connector.Addr()})
-			)
-			return func() { connections.Inc(); connects.Inc() }
-		}(),
-		CountDisconnect: func() func() {
-			var (
-				connections = metrics.backend.connections.With(prometheus.Labels{"host": connector.Addr()})
-				disconnects = metrics.backend.disconnects.With(prometheus.Labels{"host": connector.Addr()})
-			)
-			return func() { connections.Dec(); disconnects.Inc() }
-		}(),
+				cancel()
+				close(stopped)
+			}()
+		})
 	}
 
-	srv := pgtwixt.Server{
-		Debug: logger.Log,
-		Info:  logger.Log,
+	if *upgradeSocket != "" {
+		if err = serveUpgrades(*upgradeSocket, listeners, func() { stop("upgrade") }, logger.Log); err != nil {
+			panic(err)
+		}
+	}
 
-		Cancel: func(c pgtwixt.CancellationKey) {
-			if err := connector.Cancel(c); err != nil {
-				logger.Log("msg", "Error during cancel", "error", err)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for s := range signals {
+			if s == syscall.SIGHUP {
+				for _, files := range reloadable {
+					if err := files.Load(); err != nil {
+						logger.Log("msg", "Error reloading TLS files", "error", err)
+					}
+				}
+				continue
 			}
-		},
-		Session: func(fe pgtwixt.FrontendStream, startup map[string]string) {
-			fmt.Printf("%#v\n", startup)
-			proxy.Run(fe, startup)
-		},
 
-		CountConnect: func() func() {
-			var (
-				connections = metrics.frontend.connections.With(prometheus.Labels{"bind": listen.Addr().String()})
-				connects    = metrics.frontend.connects.With(prometheus.Labels{"bind": listen.Addr().String()})
-			)
-			return func() { connections.Inc(); connects.Inc() }
-		}(),
-		CountDisconnect: func() func() {
-			var (
-				connections = metrics.frontend.connections.With(prometheus.Labels{"bind": listen.Addr().String()})
-				disconnects = metrics.frontend.disconnects.With(prometheus.Labels{"bind": listen.Addr().String()})
-			)
-			return func() { connections.Dec(); disconnects.Inc() }
-		}(),
-	}
-
-	err = srv.Serve(listen)
-	if err != nil {
+			stop(s.String())
+		}
+	}()
+
+	if err = tookOver(); err != nil {
 		panic(err)
 	}
+
+	errc := make(chan error, len(servers))
+	for i := range servers {
+		go func(srv *pgtwixt.Server, l net.Listener) { errc <- srv.Serve(l) }(servers[i], listeners[i])
+	}
+	for range servers {
+		if err = <-errc; err != pgtwixt.ErrServerClosed {
+			panic(err)
+		}
+	}
+	<-stopped
 }
@@ -14,6 +14,8 @@ var metrics struct {
 		connections *prometheus.GaugeVec
 		connects    *prometheus.CounterVec
 		disconnects *prometheus.CounterVec
+
+		loginTimeouts *prometheus.CounterVec
 	}
 }
 
@@ -67,6 +69,12 @@ func init() {
 		}, []string{"bind"})
 		frontend.MustRegister(metrics.frontend.disconnects)
 
+		metrics.frontend.loginTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pgtwixt_login_timeouts_total",
+			Help: "Total number of frontends disconnected for not logging in before the timeout.",
+		}, []string{"bind"})
+		frontend.MustRegister(metrics.frontend.loginTimeouts)
+
 		return
 	}())
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cbandy/pgtwixt"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Routes builds a Proxy for each connection string of backends. Listeners
+// with the same target share its Proxy and pool, and every Proxy shares
+// Cancellations so that a cancel request can arrive on any listener.
+type Routes struct {
+	Info   pgtwixt.LogFunc
+	Strict bool // reject unknown keywords in connection strings
+
+	Cancellations *pgtwixt.Cancellations
+
+	// Login completes startup of backends in the proxy, for frontends that
+	// the Server authenticates.
+	Login bool
+
+	// PoolMode and Pool, when set, share backends between frontends. Pool
+	// returns a new Pool for each target.
+	PoolMode string
+	Pool     func() *pgtwixt.Pool
+
+	// Authenticated is true when the Server authenticates every frontend.
+	// Pooled backends log in with the credentials of the target, so pooling
+	// requires it.
+	Authenticated bool
+
+	// Reloadable holds the SSL files of every target.
+	Reloadable []*pgtwixt.TLSFiles
+
+	proxies map[string]*pgtwixt.Proxy
+}
+
+// Proxy returns the Proxy to the backends of target, a connection string that
+// is completed by its service and the environment.
+func (r *Routes) Proxy(target string) (*pgtwixt.Proxy, error) {
+	if proxy, ok := r.proxies[target]; ok {
+		return proxy, nil
+	}
+
+	var connstr pgtwixt.ConnectionString
+	var err error
+	if r.Strict {
+		err = connstr.ParseStrict(target)
+	} else {
+		err = connstr.Parse(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	connstr, err = Connector{}.Service(connstr)
+	if err != nil {
+		return nil, err
+	}
+	connstr.Merge(pgtwixt.Environment(os.Getenv))
+	r.Info("msg", "Connecting to backends", "conninfo", connstr.Redacted())
+
+	sslFiles, err := Connector{}.LoadSSLFiles(connstr)
+	if err != nil {
+		return nil, err
+	}
+	if sslFiles != nil {
+		r.Reloadable = append(r.Reloadable, sslFiles)
+	}
+
+	ds, err := Connector{Debug: r.Info, SSLFiles: sslFiles}.Dialers(connstr)
+	if err != nil {
+		return nil, err
+	}
+
+	failover := pgtwixt.FailoverDialer{
+		Info:    r.Info,
+		Dialers: ds,
+		Shuffle: connstr.LoadBalanceHosts == "random",
+	}
+	if connstr.ConnectTimeout != "" {
+		failover.Timeout, err = connstr.SecondsDuration(connstr.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	passfile, err := Connector{Debug: r.Info}.Passfile(connstr)
+	if err != nil {
+		return nil, err
+	}
+
+	connector := pgtwixt.Connector{
+		Dialer:             failover,
+		TargetSessionAttrs: connstr.TargetSessionAttrs,
+
+		Password:       connstr.Password,
+		Passfile:       passfile,
+		ChannelBinding: connstr.ChannelBinding,
+	}
+	proxy := &pgtwixt.Proxy{
+		Info:   r.Info,
+		Target: connector.Addr(),
+
+		Startup:       connector.Startup,
+		Cancellations: r.Cancellations,
+
+		CountConnect: func() func() {
+			var (
+				connections = metrics.backend.connections.With(prometheus.Labels{"host": connector.Addr()})
+				connects    = metrics.backend.connects.With(prometheus.Labels{"host": connector.Addr()})
+			)
+			return func() { connections.Inc(); connects.Inc() }
+		}(),
+		CountDisconnect: func() func() {
+			var (
+				connections = metrics.backend.connections.With(prometheus.Labels{"host": connector.Addr()})
+				disconnects = metrics.backend.disconnects.With(prometheus.Labels{"host": connector.Addr()})
+			)
+			return func() { connections.Dec(); disconnects.Inc() }
+		}(),
+	}
+	if r.Login {
+		proxy.Login = connector.Login
+	}
+
+	switch r.PoolMode {
+	case "":
+		// Frontends authenticate through to the backend, so its attributes
+		// cannot be checked before the session has begun.
+		if a := connstr.TargetSessionAttrs; a != "" && a != "any" && proxy.Login == nil {
+			return nil, fmt.Errorf("target_session_attrs requires -auth-file or -pool-mode")
+		}
+	case pgtwixt.PoolSession, pgtwixt.PoolTransaction:
+		if !r.Authenticated {
+			return nil, fmt.Errorf("-pool-mode requires -auth-file, or -peer-auth with only Unix sockets")
+		}
+		proxy.PoolMode = r.PoolMode
+		proxy.Login = connector.Login
+		proxy.Pool = r.Pool()
+		proxy.Pool.Info = r.Info
+		proxy.Pool.CountConnect = proxy.CountConnect
+		proxy.Pool.CountDisconnect = proxy.CountDisconnect
+		go proxy.Pool.Maintain(context.Background(), 10*time.Second)
+	default:
+		return nil, fmt.Errorf("unknown pool mode: %q", r.PoolMode)
+	}
+
+	if r.proxies == nil {
+		r.proxies = make(map[string]*pgtwixt.Proxy)
+	}
+	r.proxies[target] = proxy
+	return proxy, nil
+}
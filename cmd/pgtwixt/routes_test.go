@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cbandy/pgtwixt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutes(t *testing.T) {
+	t.Parallel()
+
+	var pools int
+	routes := &Routes{
+		Info:          func(...interface{}) error { return nil },
+		Cancellations: new(pgtwixt.Cancellations),
+		PoolMode:      pgtwixt.PoolTransaction,
+		Authenticated: true,
+		Pool: func() *pgtwixt.Pool {
+			pools++
+			return &pgtwixt.Pool{MaxSize: 3}
+		},
+	}
+
+	old, err := routes.Proxy("host=127.0.0.1 port=5432 sslmode=disable")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5432", old.Target)
+	assert.Equal(t, pgtwixt.PoolTransaction, old.PoolMode)
+	assert.Equal(t, 3, old.Pool.MaxSize)
+	assert.True(t, old.Cancellations == routes.Cancellations)
+
+	same, err := routes.Proxy("host=127.0.0.1 port=5432 sslmode=disable")
+	require.NoError(t, err)
+	assert.True(t, old == same, "Expected one proxy per target")
+
+	other, err := routes.Proxy("host=127.0.0.1 port=5433 sslmode=disable")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5433", other.Target)
+	assert.True(t, old.Pool != other.Pool, "Expected a pool per target")
+	assert.True(t, old.Cancellations == other.Cancellations, "Expected shared cancellations")
+	assert.Equal(t, 2, pools)
+
+	_, err = routes.Proxy("host=")
+	assert.Error(t, err)
+
+	routes.Strict = true
+	_, err = routes.Proxy("host=127.0.0.1 bogus=1")
+	assert.Error(t, err)
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		routes := &Routes{
+			Info:          func(...interface{}) error { return nil },
+			Cancellations: new(pgtwixt.Cancellations),
+			Pool:          func() *pgtwixt.Pool { return new(pgtwixt.Pool) },
+		}
+
+		// Frontends authenticate through to unpooled backends.
+		_, err := routes.Proxy("host=127.0.0.1 port=5432 sslmode=disable")
+		assert.NoError(t, err)
+
+		// Pooled backends would log in anyone without a password.
+		for _, mode := range []string{pgtwixt.PoolSession, pgtwixt.PoolTransaction} {
+			routes.PoolMode = mode
+			_, err := routes.Proxy("host=127.0.0.1 port=5433 sslmode=disable")
+			if assert.Error(t, err, mode) {
+				assert.Contains(t, err.Error(), "-auth-file")
+			}
+		}
+	})
+}
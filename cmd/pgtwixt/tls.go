@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/cbandy/pgtwixt"
+)
+
+// ServerTLS holds the TLS settings of the frontend listener.
+type ServerTLS struct {
+	CertFile, KeyFile string
+	ClientCAFile      string
+	ClientCert        string // "", "verify-ca", or "verify-full"
+	MinVersion        string // "1.0", "1.1", "1.2", or "1.3"
+	CipherSuites      string // comma-separated names, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+}
+
+// Config returns a tls.Config for the listener or nil when there is no
+// certificate. The files it reads can be reloaded through the returned
+// TLSFiles.
+func (s ServerTLS) Config() (*tls.Config, *pgtwixt.TLSFiles, error) {
+	if s.CertFile == "" && s.KeyFile == "" {
+		if s.ClientCert != "" {
+			return nil, nil, fmt.Errorf("client certificates require a server certificate")
+		}
+		return nil, nil, nil
+	}
+
+	files := &pgtwixt.TLSFiles{CertFile: s.CertFile, KeyFile: s.KeyFile, CAFile: s.ClientCAFile}
+	if err := files.Load(); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := new(tls.Config)
+
+	switch s.MinVersion {
+	case "1.0":
+		cfg.MinVersion = tls.VersionTLS10
+	case "1.1":
+		cfg.MinVersion = tls.VersionTLS11
+	case "", "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, nil, fmt.Errorf("unknown TLS version: %q", s.MinVersion)
+	}
+
+	if s.CipherSuites != "" {
+		known := make(map[string]uint16)
+		for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			known[cs.Name] = cs.ID
+		}
+		for _, name := range strings.Split(s.CipherSuites, ",") {
+			id, ok := known[strings.TrimSpace(name)]
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown cipher suite: %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	if s.ClientCAFile != "" {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	switch s.ClientCert {
+	case "":
+	case "verify-ca", "verify-full":
+		if s.ClientCAFile == "" {
+			return nil, nil, fmt.Errorf("client certificates require a client CA")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, fmt.Errorf("unknown client certificate mode: %q", s.ClientCert)
+	}
+
+	return files.ServerConfig(cfg), files, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate and its key into dir.
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// writeTestCRL writes a revocation list in which the certificate of
+// writeTestCert revokes itself.
+func writeTestCRL(t *testing.T, certFile, keyFile string) string {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, cert, pair.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	crlFile := strings.TrimSuffix(certFile, ".crt") + ".crl"
+	require.NoError(t, ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600))
+	return crlFile
+}
+
+func TestServerTLS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "localhost")
+
+	cfg, files, err := ServerTLS{}.Config()
+	assert.NoError(t, err)
+	assert.Nil(t, cfg, "Expected no TLS without a certificate")
+	assert.Nil(t, files)
+
+	cfg, files, err = ServerTLS{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: certFile,
+		ClientCert:   "verify-full",
+		MinVersion:   "1.3",
+		CipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	}.Config()
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, cfg.CipherSuites)
+
+	first, err := cfg.GetCertificate(nil)
+	require.NoError(t, err)
+	client, err := cfg.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, client.ClientCAs)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, client.ClientAuth)
+
+	t.Run("Reload", func(t *testing.T) {
+		renewed, renewedKey := writeTestCert(t, dir, "renewed")
+		require.NoError(t, os.Rename(renewed, certFile))
+		require.NoError(t, os.Rename(renewedKey, keyFile))
+		require.NoError(t, files.Load())
+
+		second, err := cfg.GetCertificate(nil)
+		require.NoError(t, err)
+		assert.NotEqual(t, first.Certificate, second.Certificate,
+			"Expected new connections to use the renewed certificate")
+	})
+
+	for _, s := range []ServerTLS{
+		{ClientCert: "verify-ca"},
+		{CertFile: certFile, KeyFile: keyFile, ClientCert: "verify-ca"},
+		{CertFile: certFile, KeyFile: keyFile, ClientCert: "bogus", ClientCAFile: certFile},
+		{CertFile: certFile, KeyFile: keyFile, MinVersion: "2.0"},
+		{CertFile: certFile, KeyFile: keyFile, CipherSuites: "bogus"},
+		{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+		{CertFile: keyFile, KeyFile: certFile},
+	} {
+		_, _, err := s.Config()
+		assert.Error(t, err, "%+v", s)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// UnixSocket describes a Unix socket for frontends that is named like that of
+// PostgreSQL so that "host=<Dir> port=<Port>" connects to it.
+type UnixSocket struct {
+	Dir         string
+	Port        string
+	Permissions string // octal mode of the socket, like unix_socket_permissions
+	Group       string // owning group of the socket, like unix_socket_group
+}
+
+func (u UnixSocket) path() string { return filepath.Join(u.Dir, ".s.PGSQL."+u.Port) }
+
+// Listen locks and creates the socket. The lock file names the process that
+// owns the socket so that a socket left behind by a process that no longer
+// exists can be replaced.
+func (u UnixSocket) Listen() (net.Listener, error) {
+	path := u.path()
+	if err := u.lock(path + ".lock"); err != nil {
+		return nil, err
+	}
+
+	_ = os.Remove(path)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err == nil {
+		err = u.configure(path)
+	}
+	if err != nil {
+		if l != nil {
+			_ = l.Close()
+		}
+		_ = os.Remove(path + ".lock")
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, lock: path + ".lock", unlink: true}, nil
+}
+
+// Adopt takes ownership of a socket passed from another process.
+func (u UnixSocket) Adopt(l net.Listener) (net.Listener, error) {
+	ul, ok := l.(*net.UnixListener)
+	if !ok || ul.Addr().String() != u.path() {
+		return nil, fmt.Errorf("expected a listener on %q, got %q", u.path(), l.Addr())
+	}
+
+	// The other process does not remove the socket nor the lock file.
+	lock := u.path() + ".lock"
+	if err := writeLock(lock, os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		return nil, err
+	}
+	ul.SetUnlinkOnClose(true)
+	return &unixListener{UnixListener: ul, lock: lock, unlink: true}, nil
+}
+
+func (u UnixSocket) configure(path string) error {
+	if u.Permissions != "" {
+		mode, err := strconv.ParseUint(u.Permissions, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket permissions %q: %v", u.Permissions, err)
+		}
+		if err = os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if u.Group != "" {
+		g, err := user.LookupGroup(u.Group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+		if err = os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock creates the lock file at path, replacing one that names a process that
+// no longer exists.
+func (u UnixSocket) lock(path string) error {
+	for attempt := 0; ; attempt++ {
+		err := writeLock(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if !os.IsExist(err) || attempt > 0 {
+			return err
+		}
+
+		if pid := readLock(path); pid > 0 && pid != os.Getpid() {
+			// EPERM means the process exists but belongs to another user.
+			if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+				return fmt.Errorf("lock file %q already exists; "+
+					"is another process (PID %d) using socket %q?", path, pid, u.path())
+			}
+		}
+		_ = os.Remove(path)
+	}
+}
+
+// readLock returns the PID on the first line of the lock file at path, or zero.
+func readLock(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Scan()
+	pid, _ := strconv.Atoi(s.Text())
+	return pid
+}
+
+// writeLock writes the PID of this process to the lock file at path.
+func writeLock(path string, flag int) error {
+	f, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// unixListener removes its lock file when it closes, unless it was passed to
+// another process.
+type unixListener struct {
+	*net.UnixListener
+	lock   string
+	unlink bool
+}
+
+// SetUnlinkOnClose sets whether Close removes both the socket and the lock
+// file.
+func (l *unixListener) SetUnlinkOnClose(unlink bool) {
+	l.unlink = unlink
+	l.UnixListener.SetUnlinkOnClose(unlink)
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if l.unlink {
+		_ = os.Remove(l.lock)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".s.PGSQL.6432")
+	lock := path + ".lock"
+
+	t.Run("Listen", func(t *testing.T) {
+		l, err := UnixSocket{Dir: dir, Port: "6432", Permissions: "0770"}.Listen()
+		require.NoError(t, err)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0770), info.Mode().Perm())
+		assert.Equal(t, os.Getpid(), readLock(lock))
+
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		conn.Close()
+
+		require.NoError(t, l.Close())
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(lock)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		// PID 1 always exists.
+		require.NoError(t, ioutil.WriteFile(lock, []byte("1\n"), 0600))
+		defer os.Remove(lock)
+
+		_, err := UnixSocket{Dir: dir, Port: "6432"}.Listen()
+		assert.EqualError(t, err, `lock file "`+lock+`" already exists; `+
+			`is another process (PID 1) using socket "`+path+`"?`)
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(lock, []byte("2147483647\n"), 0600))
+		require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+
+		l, err := UnixSocket{Dir: dir, Port: "6432"}.Listen()
+		require.NoError(t, err)
+		defer l.Close()
+		assert.Equal(t, os.Getpid(), readLock(lock), "Expected the lock to be replaced")
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		_, err := UnixSocket{Dir: dir, Port: "6433", Permissions: "rwx"}.Listen()
+		assert.Error(t, err)
+		_, err = os.Stat(filepath.Join(dir, ".s.PGSQL.6433.lock"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/cbandy/pgtwixt"
+)
+
+// takeover receives the listeners of a running process over its upgrade
+// socket at path. That process drains once ack is called, so call it when the
+// listeners are about to be served. It returns no listeners when no process is
+// listening there.
+func takeover(path string) (listeners []net.Listener, ack func() error, err error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, func() error { return nil }, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if listeners, err = pgtwixt.ReceiveListeners(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	return listeners, func() error {
+		defer conn.Close()
+		_, err := conn.Write([]byte{1})
+		return err
+	}, nil
+}
+
+// serveUpgrades passes listeners to the first new process that connects to the
+// upgrade socket at path, then calls stop. Only processes of the same system
+// user may connect. Unix sockets are left in place for the new process.
+func serveUpgrades(path string, listeners []net.Listener, stop func(), info pgtwixt.LogFunc) error {
+	_ = os.Remove(path)
+	control, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = control.Close()
+		return err
+	}
+
+	// The new process replaces the socket file before this closes.
+	control.SetUnlinkOnClose(false)
+
+	go func() {
+		defer control.Close()
+
+		for {
+			conn, err := control.AcceptUnix()
+			if err != nil {
+				return
+			}
+
+			err = sameUser(conn)
+			if err == nil {
+				err = pgtwixt.SendListeners(conn, listeners...)
+			}
+			if err == nil {
+				// Wait for the new process to have the listeners.
+				_, err = io.ReadFull(conn, make([]byte, 1))
+			}
+			_ = conn.Close()
+
+			if err != nil {
+				info("msg", "Error passing listeners to new process", "error", err)
+				continue
+			}
+
+			for _, l := range listeners {
+				if ul, ok := l.(interface{ SetUnlinkOnClose(bool) }); ok {
+					ul.SetUnlinkOnClose(false)
+				}
+			}
+
+			info("msg", "Passed listeners to new process", "path", path)
+			stop()
+			return
+		}
+	}()
+	return nil
+}
+
+// sameUser returns an error when the process on the other end of conn belongs
+// to another system user, who could otherwise take the listeners.
+func sameUser(conn *net.UnixConn) error {
+	uid, err := pgtwixt.PeerUID(conn)
+	if err == nil && uid != os.Getuid() {
+		err = fmt.Errorf("refused upgrade from user ID %d", uid)
+	}
+	return err
+}
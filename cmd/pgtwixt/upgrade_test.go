@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "upgrade")
+	info := func(...interface{}) error { return nil }
+
+	ls, _, err := takeover(path)
+	assert.NoError(t, err)
+	assert.Nil(t, ls, "Expected nothing to take over")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	socket := UnixSocket{Dir: dir, Port: "5432"}
+	local, err := socket.Listen()
+	require.NoError(t, err)
+	defer local.Close()
+
+	stopped := make(chan struct{})
+	require.NoError(t, serveUpgrades(path, []net.Listener{listener, local}, func() { close(stopped) }, info))
+
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm(), "Expected only the owner to connect")
+
+	ls, ack, err := takeover(path)
+	require.NoError(t, err)
+	require.Len(t, ls, 2)
+	defer ls[0].Close()
+	assert.Equal(t, listener.Addr().String(), ls[0].Addr().String())
+
+	select {
+	case <-stopped:
+		t.Fatal("Expected the running process to wait for the new one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, ack())
+	<-stopped
+
+	adopted, err := socket.Adopt(ls[1])
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), readLock(filepath.Join(dir, ".s.PGSQL.5432.lock")))
+
+	// The running process leaves the socket and lock file to the new one.
+	require.NoError(t, local.Close())
+	assert.FileExists(t, filepath.Join(dir, ".s.PGSQL.5432"))
+	assert.FileExists(t, filepath.Join(dir, ".s.PGSQL.5432.lock"))
+
+	// The new process can be upgraded in turn.
+	require.NoError(t, serveUpgrades(path, ls[:1], func() {}, info))
+	again, ack, err := takeover(path)
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	require.NoError(t, ack())
+	again[0].Close()
+
+	require.NoError(t, adopted.Close())
+	_, err = os.Stat(filepath.Join(dir, ".s.PGSQL.5432"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, ".s.PGSQL.5432.lock"))
+	assert.True(t, os.IsNotExist(err))
+
+	t.Run("Errors", func(t *testing.T) {
+		file := filepath.Join(dir, "file")
+		require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+
+		_, _, err := takeover(filepath.Join(file, "upgrade"))
+		assert.Error(t, err, "Expected an unusable path to be reported")
+	})
+}
@@ -4,16 +4,33 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/uhoh-itsmaciek/femebe/core"
 	"github.com/uhoh-itsmaciek/femebe/proto"
-	"github.com/uhoh-itsmaciek/femebe/util"
 )
 
 type Connector struct {
 	Dialer
+
+	// TargetSessionAttrs is the "target_session_attrs" of a connection string.
+	// Login skips backends that do not have these attributes.
+	TargetSessionAttrs string
+
+	// Password answers authentication requests of the backend during Login.
+	// When it is empty, the password is looked up in Passfile.
+	Password string
+	Passfile Passfile
+
+	// ChannelBinding is the "channel_binding" of a connection string:
+	// "disable", "prefer", or "require".
+	ChannelBinding string
 }
 
 // Cancel opens a new connection to the backend and sends a CancelRequest.
@@ -33,6 +50,16 @@ func (cn Connector) Cancel(c CancellationKey) error {
 
 // Startup opens a new connection to the backend and sends a StartupMessage.
 func (cn Connector) Startup(options map[string]string) (BackendStream, error) {
+	be, err := cn.startup(options)
+	if err == nil {
+		err = be.clearDeadline()
+	}
+	return be, err
+}
+
+// startup is Startup without clearing the deadline of the Dialer, so that the
+// rest of Login is limited too.
+func (cn Connector) startup(options map[string]string) (BackendStream, error) {
 	be, err := cn.Dial(context.Background())
 
 	if err == nil {
@@ -48,6 +75,90 @@ func (cn Connector) Startup(options map[string]string) (BackendStream, error) {
 	return be, err
 }
 
+// Login opens a new connection to the backend and completes startup without
+// involving a frontend. When TargetSessionAttrs is set, each host of a
+// FailoverDialer is tried until one has those attributes.
+func (cn Connector) Login(options map[string]string) (*Backend, error) {
+	switch cn.TargetSessionAttrs {
+	case "", "any":
+		return cn.login(options)
+	case "read-write", "read-only", "primary", "standby", "prefer-standby":
+	default:
+		return nil, fmt.Errorf("invalid target_session_attrs: %q", cn.TargetSessionAttrs)
+	}
+
+	ds := []Dialer{cn.Dialer}
+	if f, ok := cn.Dialer.(FailoverDialer); ok {
+		ds = f.each()
+	}
+
+	var fallback *Backend
+	var err = errors.New("no hosts to dial")
+
+	for _, d := range ds {
+		var b *Backend
+		var ok bool
+
+		host := cn
+		host.Dialer = d
+
+		if b, err = host.login(options); err != nil {
+			continue
+		}
+		if ok, err = b.matches(cn.TargetSessionAttrs); err == nil && ok {
+			if fallback != nil {
+				_ = fallback.Close()
+			}
+			return b, nil
+		}
+
+		// "prefer-standby" settles for any host when there is no standby.
+		if err == nil && fallback == nil && cn.TargetSessionAttrs == "prefer-standby" {
+			fallback = b
+			continue
+		}
+
+		_ = b.Close()
+		if err == nil {
+			err = fmt.Errorf("session attributes of %s are not %q", d.Addr(), cn.TargetSessionAttrs)
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, err
+}
+
+func (cn Connector) login(options map[string]string) (*Backend, error) {
+	be, err := cn.startup(options)
+	if err != nil {
+		return nil, err
+	}
+
+	user := options["user"]
+	password := cn.Password
+	if password == "" && len(cn.Passfile) > 0 {
+		database := options["database"]
+		if database == "" {
+			database = user
+		}
+		host, port := passfileHost(be.dialer)
+		password, _ = cn.Passfile.Password(host, port, database, user)
+	}
+
+	b := &Backend{BackendStream: be}
+	if err = b.login(user, password, cn.ChannelBinding); err == nil {
+		err = be.clearDeadline()
+	}
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
 type Dialer interface {
 	Addr() string
 	Dial(context.Context) (BackendStream, error)
@@ -57,57 +168,232 @@ type TCPDialer struct {
 	Debug LogFunc
 
 	Address   string // "yahoo.com:8080" "1.2.3.4:9999"
+	Host      string // "host" of the connection string when Address is its "hostaddr"
 	SSLMode   string
-	SSLConfig tls.Config
+	SSLConfig *tls.Config
+	SSLFiles  *TLSFiles // client certificate, root certificates, and CRL, when set
 	Timeout   time.Duration
 
 	KeepAlivesCount    int
 	KeepAlivesDisable  bool
 	KeepAlivesIdle     time.Duration
 	KeepAlivesInterval time.Duration
+	UserTimeout        time.Duration // TCP_USER_TIMEOUT, "tcp_user_timeout"
 	// https://github.com/golang/go/blob/master/src/net/tcpsockopt_*.go
 }
 
 func (d TCPDialer) Addr() string { return d.Address }
 
 // Dial opens a new connection to the backend, negotiates any TLS upgrade, and verifies server certificates.
+// The deadline of ctx, if any, remains on the connection until the caller clears it.
 func (d TCPDialer) Dial(ctx context.Context) (BackendStream, error) {
 	nd := net.Dialer{Timeout: d.Timeout}
 	conn, err := nd.DialContext(ctx, "tcp", d.Address)
 
 	if err == nil {
-		err = conn.(*net.TCPConn).SetKeepAlive(true)
+		err = setKeepAlives(conn.(*net.TCPConn), d.KeepAlivesDisable,
+			d.KeepAlivesIdle, d.KeepAlivesInterval, d.KeepAlivesCount, d.UserTimeout)
 	}
 	if err == nil {
-		cfg := util.SSLConfig{Mode: util.SSLMode(d.SSLMode), Config: d.SSLConfig}
-		cfg.Config.InsecureSkipVerify = d.SSLMode != "verify-full"
-		conn, err = util.NegotiateTLS(conn, &cfg)
+		err = setDeadline(ctx, conn)
 	}
+	cfg := d.config()
 	if err == nil {
-		err = d.verify(conn)
+		conn, err = d.negotiate(conn, cfg)
+	}
+	if err == nil {
+		err = d.verify(ctx, conn, cfg)
 	}
 
 	return BackendStream{
 		debug:  d.Debug,
 		stream: core.NewBackendStream(conn),
+		dialer: d,
+		conn:   conn,
 	}, err
 }
 
-func (d TCPDialer) verify(conn net.Conn) error {
+// setDeadline limits conn to the deadline of ctx, like "connect_timeout" in
+// libpq, so that a backend that accepts and then stalls does not block
+// failover.
+func setDeadline(ctx context.Context, conn net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		return conn.SetDeadline(deadline)
+	}
+	return nil
+}
+
+// clearDeadline removes the deadline of the Dialer from the connection.
+func (be BackendStream) clearDeadline() error {
+	if be.conn == nil {
+		return nil
+	}
+	return be.conn.SetDeadline(time.Time{})
+}
+
+// setKeepAlives applies the TCP keepalive settings and user timeout to conn.
+// Zero leaves the current setting, which package net makes 15 seconds for the
+// idle time and interval of connections it dials and accepts.
+func setKeepAlives(conn *net.TCPConn, disable bool, idle, interval time.Duration, count int, userTimeout time.Duration) error {
+	err := conn.SetKeepAlive(!disable)
+	if disable {
+		idle, interval, count = 0, 0, 0
+	}
+	if err == nil {
+		err = setTCPSockopts(conn, idle, interval, count, userTimeout)
+	}
+	return err
+}
+
+// config returns the tls.Config of a new connection, using the latest of
+// SSLFiles.
+func (d TCPDialer) config() *tls.Config {
+	cfg := new(tls.Config)
+	if d.SSLConfig != nil {
+		cfg = d.SSLConfig.Clone()
+	}
+	cfg.InsecureSkipVerify = d.SSLMode != "verify-full"
+
+	if d.SSLFiles != nil {
+		cfg.GetClientCertificate = d.SSLFiles.GetClientCertificate
+		if pool := d.SSLFiles.CertPool(); pool != nil {
+			cfg.RootCAs = pool
+		}
+	}
+	return cfg
+}
+
+// negotiate sends an SSLRequest according to SSLMode and upgrades the
+// connection when the backend accepts.
+func (d TCPDialer) negotiate(conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	if d.SSLMode == "disable" {
+		return conn, nil
+	}
+
+	if _, err := conn.Write([]byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}); err != nil {
+		return conn, err
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return conn, err
+	}
+
+	switch {
+	case response[0] == core.AcceptSSLRequest:
+		return tls.Client(conn, cfg), nil
+	case response[0] == core.RejectSSLRequest && (d.SSLMode == "allow" || d.SSLMode == "prefer"):
+		return conn, nil
+	case response[0] == core.RejectSSLRequest:
+		return conn, errors.New("SSL required but declined by server")
+	default:
+		return conn, fmt.Errorf("unexpected response to SSLRequest: %q", response[0])
+	}
+}
+
+func (d TCPDialer) verify(ctx context.Context, conn net.Conn, cfg *tls.Config) error {
 	tc, ok := conn.(*tls.Conn)
 	if !ok {
 		return nil
 	}
 
-	err := tc.Handshake()
-	if err == nil && d.SSLMode == "verify-ca" {
-		s := tc.ConnectionState()
-		v := x509.VerifyOptions{Roots: d.SSLConfig.RootCAs}
+	err := tc.HandshakeContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// "require" verifies the chain when there is a root certificate file, as
+	// it did in libpq before "verify-ca" was added.
+	verifyCA := d.SSLMode == "verify-ca" ||
+		d.SSLMode == "require" && d.SSLFiles != nil && d.SSLFiles.CertPool() != nil
+
+	s := tc.ConnectionState()
+	if verifyCA && len(s.PeerCertificates) > 0 {
+		v := x509.VerifyOptions{Roots: cfg.RootCAs, Intermediates: x509.NewCertPool()}
+		for _, c := range s.PeerCertificates[1:] {
+			v.Intermediates.AddCert(c)
+		}
+		_, err = s.PeerCertificates[0].Verify(v)
+	}
 
-		if len(s.PeerCertificates) > 0 {
-			_, err = s.PeerCertificates[0].Verify(v)
+	// Check revocation of every certificate the server sent, not only its own.
+	if err == nil && d.SSLFiles != nil {
+		for _, c := range s.PeerCertificates {
+			if d.SSLFiles.Revoked(c) {
+				return fmt.Errorf("server certificate %q is revoked", c.Subject.String())
+			}
 		}
 	}
 
 	return err
 }
+
+// FailoverDialer tries each of its Dialers until one connects, the way libpq
+// tries each host of a connection string.
+type FailoverDialer struct {
+	Info LogFunc
+
+	Dialers []Dialer
+	Shuffle bool          // try Dialers in random order, "load_balance_hosts=random"
+	Timeout time.Duration // limit on each attempt, zero is no limit
+}
+
+func (d FailoverDialer) Addr() string {
+	addrs := make([]string, len(d.Dialers))
+	for i := range d.Dialers {
+		addrs[i] = d.Dialers[i].Addr()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Dial opens a new connection using the first of Dialers that succeeds. The
+// returned stream cancels through the Dialer that opened it.
+func (d FailoverDialer) Dial(ctx context.Context) (BackendStream, error) {
+	ds := d.order()
+
+	var be BackendStream
+	var err = errors.New("no hosts to dial")
+
+	for _, dialer := range ds {
+		be, err = d.dial(ctx, dialer)
+		if err == nil {
+			d.Info("msg", "Connected to backend", "host", dialer.Addr())
+			return be, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		d.Info("msg", "Error connecting to backend", "host", dialer.Addr(), "error", err)
+	}
+
+	return be, err
+}
+
+// order returns Dialers in the order they should be tried.
+func (d FailoverDialer) order() []Dialer {
+	ds := append([]Dialer(nil), d.Dialers...)
+	if d.Shuffle {
+		rand.Shuffle(len(ds), func(i, j int) { ds[i], ds[j] = ds[j], ds[i] })
+	}
+	return ds
+}
+
+// each splits d into a FailoverDialer for each of its hosts, in the order they
+// should be tried.
+func (d FailoverDialer) each() []Dialer {
+	ds := d.order()
+	for i := range ds {
+		ds[i] = FailoverDialer{Info: d.Info, Dialers: []Dialer{ds[i]}, Timeout: d.Timeout}
+	}
+	return ds
+}
+
+func (d FailoverDialer) dial(ctx context.Context, dialer Dialer) (BackendStream, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	return dialer.Dial(ctx)
+}
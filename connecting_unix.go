@@ -23,10 +23,14 @@ type UnixDialer struct {
 func (d UnixDialer) Addr() string { return d.Address }
 
 // Dial opens a new connection to the backend and verifies the owner of the socket.
+// The deadline of ctx, if any, remains on the connection until the caller clears it.
 func (d UnixDialer) Dial(ctx context.Context) (BackendStream, error) {
 	nd := net.Dialer{Timeout: d.Timeout}
 	conn, err := nd.DialContext(ctx, "unix", d.Address)
 
+	if err == nil {
+		err = setDeadline(ctx, conn)
+	}
 	if err == nil {
 		err = d.verify(conn)
 	}
@@ -34,6 +38,8 @@ func (d UnixDialer) Dial(ctx context.Context) (BackendStream, error) {
 	return BackendStream{
 		debug:  d.Debug,
 		stream: core.NewBackendStream(conn),
+		dialer: d,
+		conn:   conn,
 	}, err
 }
 
@@ -42,13 +48,36 @@ func (d UnixDialer) verify(conn net.Conn) error {
 		return nil
 	}
 
+	name, err := peerUser(conn.(*net.UnixConn))
+	if err == nil && name != d.RequirePeer {
+		err = fmt.Errorf("peer user name %q is not %q", name, d.RequirePeer)
+	}
+	return err
+}
+
+// peerUser returns the name of the system user on the other end of conn.
+func peerUser(conn *net.UnixConn) (string, error) {
+	uid, err := PeerUID(conn)
+
+	var u *user.User
+	if err == nil {
+		u, err = user.LookupId(strconv.Itoa(uid))
+	}
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+// PeerUID returns the ID of the system user on the other end of conn.
+func PeerUID(conn *net.UnixConn) (int, error) {
 	var (
 		ucred *syscall.Ucred
 		ucerr error
 	)
 
 	// https://github.com/golang/go/issues/22953
-	src, err := conn.(*net.UnixConn).SyscallConn()
+	src, err := conn.SyscallConn()
 	if err == nil {
 		err = src.Control(func(fd uintptr) {
 			ucred, ucerr = syscall.GetsockoptUcred(int(fd),
@@ -58,14 +87,8 @@ func (d UnixDialer) verify(conn net.Conn) error {
 	if err == nil {
 		err = ucerr
 	}
-
-	if err == nil {
-		var u *user.User
-		u, err = user.LookupId(strconv.Itoa(int(ucred.Uid)))
-		if err == nil && u.Username != d.RequirePeer {
-			err = fmt.Errorf("peer user name %q is not %q", u.Username, d.RequirePeer)
-		}
+	if err != nil {
+		return 0, err
 	}
-
-	return err
+	return int(ucred.Uid), nil
 }
@@ -12,18 +12,55 @@ type Grammar struct {
 	Value func(key, value string) error
 }
 
+// SyntaxError is returned by Parse when text cannot be parsed or when Value
+// returns an error.
+type SyntaxError struct {
+	Offset  int    // byte offset of the error in text
+	Key     string // key being parsed, if any
+	Snippet string // text at Offset
+	Err     error
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("at offset %d near %q, key %q: %v", e.Offset, e.Snippet, e.Key, e.Err)
+	}
+	return fmt.Sprintf("at offset %d near %q: %v", e.Offset, e.Snippet, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error { return e.Err }
+
+// valueError is an error of Value, which is reported at the start of its key.
+type valueError struct{ error }
+
 func (g Grammar) Parse(text string) error {
+	input := text
 	text = g.trim(text)
 
-	var err error
-	for err == nil && len(text) > 0 {
-		text, err = g.parseKey(text)
+	for len(text) > 0 {
+		pair := text
+
+		var key string
+		var err error
+		if text, key, err = g.parseKey(text); err != nil {
+			if ve, ok := err.(valueError); ok {
+				text, err = pair, ve.error
+			}
+
+			offset := len(input) - len(text)
+			snippet := text
+			if len(snippet) > 20 {
+				snippet = snippet[:20]
+			}
+			return &SyntaxError{Offset: offset, Key: key, Snippet: snippet, Err: err}
+		}
 	}
 
-	return err
+	return nil
 }
 
-func (g Grammar) parseKey(text string) (string, error) {
+// parseKey reads a key and its value. It returns the key along with any error.
+func (g Grammar) parseKey(text string) (string, string, error) {
 	var r rune
 	var w int
 
@@ -32,21 +69,24 @@ func (g Grammar) parseKey(text string) (string, error) {
 		text = g.trim(text)
 
 		if err != nil {
-			return text, err
+			return text, "", err
 		}
 
 		if r, w = utf8.DecodeRuneInString(text); r == '=' {
-			return g.parseValue(g.trim(text[w:]), key)
+			text, err = g.parseValue(g.trim(text[w:]), key)
+			return text, key, err
 		}
 
-		return text, fmt.Errorf("expected '=', got %q", r)
+		return text, key, fmt.Errorf("expected '=', got %q", r)
 	}
 
 	for i := 0; i < len(text); i += w {
 		r, w = utf8.DecodeRuneInString(text[i:])
 
 		if r == '=' {
-			return g.parseValue(g.trim(text[i+w:]), text[:i])
+			key := text[:i]
+			text, err := g.parseValue(g.trim(text[i+w:]), key)
+			return text, key, err
 		}
 
 		if unicode.IsSpace(r) {
@@ -54,14 +94,15 @@ func (g Grammar) parseKey(text string) (string, error) {
 			text = g.trim(text[i:])
 
 			if r, w = utf8.DecodeRuneInString(text); r == '=' {
-				return g.parseValue(g.trim(text[w:]), key)
+				text, err := g.parseValue(g.trim(text[w:]), key)
+				return text, key, err
 			}
 
-			return text, fmt.Errorf("expected '=', got %q", r)
+			return text, key, fmt.Errorf("expected '=', got %q", r)
 		}
 	}
 
-	return "", errors.New("expected '=' before end")
+	return "", text, errors.New("expected '=' before end")
 }
 
 func (g Grammar) parseQuoted(text string) (string, string, error) {
@@ -103,14 +144,14 @@ func (g Grammar) parseValue(text string, key string) (string, error) {
 			return text, err
 		}
 
-		return text, g.Value(key, value)
+		return text, g.value(key, value)
 	}
 
 	for i := 0; i < len(text); i += w {
 		r, w = utf8.DecodeRuneInString(text[i:])
 
 		if unicode.IsSpace(r) {
-			return g.trim(text[i:]), g.Value(key, text[:i])
+			return g.trim(text[i:]), g.value(key, text[:i])
 		}
 	}
 
@@ -118,7 +159,34 @@ func (g Grammar) parseValue(text string, key string) (string, error) {
 		return "", errors.New("expected value before end")
 	}
 
-	return "", g.Value(key, text)
+	return "", g.value(key, text)
+}
+
+func (g Grammar) value(key, value string) error {
+	if err := g.Value(key, value); err != nil {
+		return valueError{err}
+	}
+	return nil
+}
+
+// Quote returns text as a value that Parse reads back unchanged. It is quoted
+// only when necessary.
+func (Grammar) Quote(text string) string {
+	if text != "" && !strings.ContainsAny(text, "'\\") &&
+		strings.IndexFunc(text, unicode.IsSpace) < 0 {
+		return text
+	}
+
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range text {
+		if r == '\'' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
 }
 
 func (Grammar) trim(text string) string {
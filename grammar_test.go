@@ -1,6 +1,7 @@
 package pgtwixt
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -66,3 +67,71 @@ func TestGrammarValues(t *testing.T) {
 		})
 	}
 }
+
+func TestGrammarQuote(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		input, expected string
+	}{
+		{`b`, `b`},
+		{`a=b`, `a=b`},
+		{``, `''`},
+		{`a b`, `'a b'`},
+		{"a\tb", "'a\tb'"},
+		{`it's`, `'it\'s'`},
+		{`C:\dir`, `'C:\\dir'`},
+	} {
+		assert.Equal(t, tt.expected, Grammar{}.Quote(tt.input), "%q", tt.input)
+
+		var value string
+		require.NoError(t, Grammar{Value: func(_, v string) error {
+			value = v
+			return nil
+		}}.Parse("k="+Grammar{}.Quote(tt.input)))
+		assert.Equal(t, tt.input, value, "Expected round trip of %q", tt.input)
+	}
+}
+
+func TestGrammarSyntaxError(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		input  string
+		offset int
+		key    string
+	}{
+		{`a`, 1, `a`},
+		{`a=b c d=e`, 6, `c`},
+		{`a=b 'c`, 5, ``},
+		{`a=b 'c' d`, 8, `c`},
+		{`a=b c=`, 6, `c`},
+		{`a=b c='d`, 7, `c`},
+	} {
+		err := Grammar{Value: func(string, string) error { return nil }}.Parse(tt.input)
+
+		var se *SyntaxError
+		require.True(t, errors.As(err, &se), "%q: %v", tt.input, err)
+		assert.Equal(t, tt.offset, se.Offset, "%q", tt.input)
+		assert.Equal(t, tt.key, se.Key, "%q", tt.input)
+		assert.Equal(t, tt.input[tt.offset:], se.Snippet, "%q", tt.input)
+	}
+
+	t.Run("Value", func(t *testing.T) {
+		bad := errors.New("bad")
+		err := Grammar{Value: func(key, _ string) error {
+			if key == "c" {
+				return bad
+			}
+			return nil
+		}}.Parse(`a=b  c='d e' f=g`)
+
+		var se *SyntaxError
+		require.True(t, errors.As(err, &se))
+		assert.Equal(t, 5, se.Offset, "Expected the start of the key")
+		assert.Equal(t, "c", se.Key)
+		assert.Equal(t, `c='d e' f=g`, se.Snippet)
+		assert.True(t, errors.Is(err, bad))
+		assert.Contains(t, err.Error(), "offset 5")
+	})
+}
@@ -0,0 +1,98 @@
+package pgtwixt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// filer is implemented by *net.TCPListener and *net.UnixListener.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// SendListeners passes listening sockets to another process over conn using
+// SCM_RIGHTS, so that it can accept connections without a gap. Connections
+// that were already accepted are not passed; drain them with Shutdown.
+func SendListeners(conn *net.UnixConn, listeners ...net.Listener) error {
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	fds := make([]int, 0, len(listeners))
+	names := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return fmt.Errorf("cannot pass listener of type %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		fds = append(fds, int(f.Fd()))
+		names = append(names, l.Addr().String())
+	}
+
+	// The addresses only name the files; sockets do not need them.
+	_, _, err := conn.WriteMsgUnix([]byte(strings.Join(names, "\n")), syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// ReceiveListeners accepts the listening sockets of SendListeners.
+func ReceiveListeners(conn *net.UnixConn) ([]net.Listener, error) {
+	data := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(64*4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(data, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+
+	names := strings.Split(string(data[:n]), "\n")
+	if len(fds) == 0 || len(fds) != len(names) {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+		return nil, errors.New("malformed listener handoff")
+	}
+
+	listeners := make([]net.Listener, 0, len(fds))
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), names[i])
+		l, err := net.FileListener(f)
+		_ = f.Close()
+
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			for _, fd := range fds[i+1:] {
+				_ = syscall.Close(fd)
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,72 @@
+package pgtwixt
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerHandoff(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	defer tcp.Close()
+	unix, err := net.Listen("unix", filepath.Join(dir, ".s.PGSQL.5432"))
+	require.NoError(t, err)
+	defer unix.Close()
+
+	control, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "control"), Net: "unix"})
+	require.NoError(t, err)
+	defer control.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		conn, err := control.AcceptUnix()
+		if err == nil {
+			defer conn.Close()
+			err = SendListeners(conn, tcp, unix)
+		}
+		sent <- err
+	}()
+
+	conn, err := net.DialUnix("unix", nil, control.Addr().(*net.UnixAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	listeners, err := ReceiveListeners(conn)
+	require.NoError(t, err)
+	require.NoError(t, <-sent)
+	require.Len(t, listeners, 2)
+
+	// The original listeners go away, but the sockets remain.
+	require.NoError(t, tcp.Close())
+
+	for i, original := range []net.Listener{tcp, unix} {
+		l := listeners[i]
+		defer l.Close()
+		assert.Equal(t, original.Addr().String(), l.Addr().String())
+
+		go func(addr net.Addr) {
+			if c, err := net.Dial(addr.Network(), addr.String()); err == nil {
+				c.Close()
+			}
+		}(original.Addr())
+		c, err := l.Accept()
+		require.NoError(t, err)
+		c.Close()
+	}
+
+	t.Run("NotSocket", func(t *testing.T) {
+		assert.Error(t, SendListeners(conn, struct{ net.Listener }{tcp}))
+	})
+}
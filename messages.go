@@ -0,0 +1,195 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// force reads the entire payload of a message into memory so that it can be
+// read more than once. The Payload of a partially buffered message cannot be
+// read again after Force.
+func force(m *core.Message) error {
+	b, err := m.Force()
+	if err == nil {
+		m.InitFromBytes(m.MsgType(), b)
+	}
+	return err
+}
+
+// gssencRequestCode is sent in place of a protocol version by a frontend that
+// wants to use GSSAPI encryption.
+const gssencRequestCode = 80877104
+
+// readStartupVersion returns the protocol version or request code of the
+// first message from a frontend.
+func readStartupVersion(m *core.Message) (major, minor uint16, ok bool) {
+	if m.MsgType() != core.MsgTypeFirst {
+		return 0, 0, false
+	}
+	b, err := m.Force()
+	if err != nil || len(b) < 4 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:]), true
+}
+
+func isGSSENCRequest(m *core.Message) bool {
+	major, minor, ok := readStartupVersion(m)
+	return ok && uint32(major)<<16|uint32(minor) == gssencRequestCode
+}
+
+// isStartupMessage reports whether m is a StartupMessage of any minor version
+// of protocol 3.
+func isStartupMessage(m *core.Message) bool {
+	major, _, ok := readStartupVersion(m)
+	return ok && major == 3
+}
+
+// readStartupMessage returns the minor version and parameters of a
+// StartupMessage. Unlike femebe, it accepts any minor version of protocol 3.
+func readStartupMessage(m *core.Message) (minor uint16, params map[string]string, err error) {
+	if m.Size()-4 > 10000 {
+		return 0, nil, fmt.Errorf("startup packet is too long: %d", m.Size()-4)
+	}
+	var b []byte
+	if b, err = m.Force(); err != nil {
+		return
+	}
+	if len(b) < 5 || b[len(b)-1] != 0 {
+		return 0, nil, fmt.Errorf("startup packet is malformed")
+	}
+	minor = binary.BigEndian.Uint16(b[2:])
+
+	params = make(map[string]string)
+	r := bytes.NewReader(b[4 : len(b)-1])
+	for r.Len() > 0 {
+		var name, value string
+		if name, err = buf.ReadCString(r); err == nil {
+			value, err = buf.ReadCString(r)
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("startup packet is malformed: %v", err)
+		}
+		params[name] = value
+	}
+	return
+}
+
+// initNegotiateProtocolVersion reports the newest minor version and the
+// protocol options that are not supported.
+func initNegotiateProtocolVersion(m *core.Message, minor uint32, options []string) {
+	b := bytes.NewBuffer(make([]byte, 0, 8))
+	_, _ = buf.WriteUint32(b, minor)
+	_, _ = buf.WriteUint32(b, uint32(len(options)))
+	for _, option := range options {
+		_, _ = buf.WriteCString(b, option)
+	}
+	m.InitFromBytes('v', b.Bytes())
+}
+
+func initParameterStatus(m *core.Message, name, value string) {
+	b := bytes.NewBuffer(make([]byte, 0, len(name)+len(value)+2))
+	_, _ = buf.WriteCString(b, name)
+	_, _ = buf.WriteCString(b, value)
+	m.InitFromBytes(proto.MsgParameterStatusS, b.Bytes())
+}
+
+func readParameterStatus(m *core.Message) (name, value string, err error) {
+	var b []byte
+	if b, err = m.Force(); err == nil {
+		r := bytes.NewReader(b)
+		if name, err = buf.ReadCString(r); err == nil {
+			value, err = buf.ReadCString(r)
+		}
+	}
+	return
+}
+
+func initAuthentication(m *core.Message, code uint32, data []byte) {
+	b := bytes.NewBuffer(make([]byte, 0, 4+len(data)))
+	_, _ = buf.WriteUint32(b, code)
+	_, _ = b.Write(data)
+	m.InitFromBytes(proto.MsgAuthenticationOkR, b.Bytes())
+}
+
+func readAuthentication(m *core.Message) (code uint32, data []byte, err error) {
+	if data, err = m.Force(); err == nil {
+		if len(data) < 4 {
+			return 0, nil, fmt.Errorf("authentication request is too short: %d", len(data))
+		}
+		code, data = uint32(data[0])<<24|uint32(data[1])<<16|uint32(data[2])<<8|uint32(data[3]), data[4:]
+	}
+	return
+}
+
+func readReadyForQuery(m *core.Message) (proto.ConnStatus, error) {
+	b, err := m.Force()
+	if err == nil && len(b) != 1 {
+		err = fmt.Errorf("ReadyForQuery is wrong size: %d", len(b))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return proto.ConnStatus(b[0]), nil
+}
+
+// ErrorResponse is an error reported by a backend. Fields are keyed by the
+// field type codes of the protocol, e.g. 'C' for SQLSTATE.
+type ErrorResponse struct {
+	Fields map[byte]string
+}
+
+func (e ErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Fields['S'], e.Fields['M'], e.Fields['C'])
+}
+
+func initErrorResponse(m *core.Message, e ErrorResponse) {
+	codes := make([]int, 0, len(e.Fields))
+	for code := range e.Fields {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	b := bytes.NewBuffer(nil)
+	for _, code := range codes {
+		_ = b.WriteByte(byte(code))
+		_, _ = buf.WriteCString(b, e.Fields[byte(code)])
+	}
+	_ = b.WriteByte(0)
+	m.InitFromBytes(proto.MsgErrorResponseE, b.Bytes())
+}
+
+func readErrorResponse(m *core.Message) error {
+	if err := force(m); err != nil {
+		return err
+	}
+	r, err := proto.ReadErrorResponse(m)
+	if err != nil {
+		return err
+	}
+	return ErrorResponse{Fields: r.Details}
+}
+
+func initBackendKeyData(m *core.Message, k CancellationKey) {
+	b := bytes.NewBuffer(make([]byte, 0, 8))
+	_, _ = buf.WriteUint32(b, k.id)
+	_, _ = buf.WriteUint32(b, k.secret)
+	m.InitFromBytes(proto.MsgBackendKeyDataK, b.Bytes())
+}
+
+func readBackendKeyData(m *core.Message) (CancellationKey, error) {
+	if err := force(m); err != nil {
+		return CancellationKey{}, err
+	}
+	k, err := proto.ReadBackendKeyData(m)
+	if err != nil {
+		return CancellationKey{}, err
+	}
+	return CancellationKey{id: k.BackendPid, secret: k.SecretKey}, nil
+}
@@ -0,0 +1,87 @@
+package pgtwixt
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Passfile is a password file like ~/.pgpass. Each line is
+// "hostname:port:database:username:password" where any of the first four
+// fields can be "*" to match anything.
+//
+// https://www.postgresql.org/docs/current/libpq-pgpass.html
+type Passfile [][5]string
+
+// ReadPassfile parses a password file. Lines that start with "#" and lines
+// with too few fields are ignored.
+func ReadPassfile(r io.Reader) (Passfile, error) {
+	var p Passfile
+	s := bufio.NewScanner(r)
+
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var entry [5]string
+		var field strings.Builder
+		var i int
+
+		for j := 0; j < len(line) && i < len(entry); j++ {
+			switch c := line[j]; {
+			case c == '\\' && j+1 < len(line):
+				j++
+				field.WriteByte(line[j])
+			case c == ':' && i < len(entry)-1:
+				entry[i] = field.String()
+				field.Reset()
+				i++
+			default:
+				field.WriteByte(c)
+			}
+		}
+
+		if i == len(entry)-1 {
+			entry[i] = field.String()
+			p = append(p, entry)
+		}
+	}
+
+	return p, s.Err()
+}
+
+// Password returns the password of the first line that matches.
+func (p Passfile) Password(host, port, database, user string) (string, bool) {
+	match := func(pattern, value string) bool { return pattern == "*" || pattern == value }
+
+	for _, e := range p {
+		if match(e[0], host) && match(e[1], port) && match(e[2], database) && match(e[3], user) {
+			return e[4], true
+		}
+	}
+	return "", false
+}
+
+// passfileHost returns the hostname and port of a Dialer as they appear in a
+// password file. Unix sockets match "localhost", and a TCPDialer of "hostaddr"
+// matches its "host", if any.
+func passfileHost(d Dialer) (host, port string) {
+	addr := d.Addr()
+	if strings.HasPrefix(addr, "/") {
+		const prefix = ".s.PGSQL."
+		if base := filepath.Base(addr); strings.HasPrefix(base, prefix) {
+			port = base[len(prefix):]
+		}
+		return "localhost", port
+	}
+
+	host, port, _ = net.SplitHostPort(addr)
+	if td, ok := d.(TCPDialer); ok && td.Host != "" {
+		host = td.Host
+	}
+	return host, port
+}
@@ -0,0 +1,56 @@
+package pgtwixt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassfile(t *testing.T) {
+	t.Parallel()
+
+	p, err := ReadPassfile(strings.NewReader(`
+# comment
+db.example.com:5432:app:mary:first
+*:*:*:mary:second
+local\:host:*:*:bob:with\:colon\\
+too:few:fields
+`))
+	require.NoError(t, err)
+	assert.Len(t, p, 3)
+
+	for _, tt := range []struct {
+		host, port, database, user string
+		expected                   string
+		found                      bool
+	}{
+		{"db.example.com", "5432", "app", "mary", "first", true},
+		{"db.example.com", "5433", "app", "mary", "second", true},
+		{"local:host", "1", "x", "bob", `with:colon\`, true},
+		{"localhost", "1", "x", "bob", "", false},
+	} {
+		password, found := p.Password(tt.host, tt.port, tt.database, tt.user)
+		assert.Equal(t, tt.expected, password)
+		assert.Equal(t, tt.found, found)
+	}
+}
+
+func TestPassfileHost(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		dialer   Dialer
+		expected [2]string
+	}{
+		{TCPDialer{Address: "db.example.com:5432"}, [2]string{"db.example.com", "5432"}},
+		{TCPDialer{Address: "[::1]:6543"}, [2]string{"::1", "6543"}},
+		{TCPDialer{Address: "10.0.0.1:5432", Host: "db.example.com"}, [2]string{"db.example.com", "5432"}},
+		{UnixDialer{Address: "/tmp/.s.PGSQL.5432"}, [2]string{"localhost", "5432"}},
+		{UnixDialer{Address: "/var/run/.s.PGSQL.15432"}, [2]string{"localhost", "15432"}},
+	} {
+		host, port := passfileHost(tt.dialer)
+		assert.Equal(t, tt.expected, [2]string{host, port}, tt.dialer.Addr())
+	}
+}
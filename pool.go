@@ -0,0 +1,246 @@
+package pgtwixt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// Pool holds backends that have completed startup so they can be shared
+// between frontends. Backends are grouped by a key that identifies the
+// parameters used to start them.
+type Pool struct {
+	Info LogFunc
+
+	MinSize     int           // number of backends per key to keep open
+	MaxSize     int           // maximum number of backends per key, zero is unlimited
+	MaxIdle     time.Duration // close backends above MinSize that are idle longer than this
+	MaxLifetime time.Duration // close backends that have been open longer than this
+
+	// Reset is sent by a Proxy before a backend that was held for a whole
+	// session is returned, e.g. "DISCARD ALL".
+	Reset string
+
+	CountConnect    func()
+	CountDisconnect func()
+
+	mu   sync.Mutex
+	sets map[string]*poolSet
+}
+
+type poolSet struct {
+	idle    []*Backend
+	open    int
+	waiting []chan *Backend
+	login   func() (*Backend, error)
+}
+
+// expired reports whether a backend has been open longer than MaxLifetime.
+func (p *Pool) expired(b *Backend, now time.Time) bool {
+	return p.MaxLifetime > 0 && now.Sub(b.created) > p.MaxLifetime
+}
+
+// Get returns an idle backend for key or calls login to start a new one. When
+// the pool is full, Get waits for another frontend to return a backend.
+func (p *Pool) Get(ctx context.Context, key string, login func() (*Backend, error)) (*Backend, error) {
+	p.mu.Lock()
+
+	if p.sets == nil {
+		p.sets = make(map[string]*poolSet)
+	}
+	set := p.sets[key]
+	if set == nil {
+		set = new(poolSet)
+		p.sets[key] = set
+	}
+	if set.login == nil {
+		set.login = login
+	}
+
+	for now := time.Now(); len(set.idle) > 0; {
+		b := set.idle[len(set.idle)-1]
+		set.idle = set.idle[:len(set.idle)-1]
+
+		if !p.expired(b, now) {
+			p.mu.Unlock()
+			return b, nil
+		}
+
+		set.open--
+		p.mu.Unlock()
+		p.close(b)
+		p.mu.Lock()
+	}
+
+	if p.MaxSize > 0 && set.open >= p.MaxSize {
+		ready := make(chan *Backend, 1)
+		set.waiting = append(set.waiting, ready)
+		p.mu.Unlock()
+
+		select {
+		case b := <-ready:
+			if b != nil {
+				return b, nil
+			}
+			// The slot of a closed backend was handed over.
+			return p.login(key, login)
+
+		case <-ctx.Done():
+			p.mu.Lock()
+			for i := range set.waiting {
+				if set.waiting[i] == ready {
+					set.waiting = append(set.waiting[:i], set.waiting[i+1:]...)
+					break
+				}
+			}
+			p.mu.Unlock()
+
+			// Something may have been handed over before the wait was canceled.
+			select {
+			case b := <-ready:
+				if b != nil {
+					p.Put(b)
+				} else {
+					p.release(key)
+				}
+			default:
+			}
+			return nil, ctx.Err()
+		}
+	}
+
+	set.open++
+	p.mu.Unlock()
+
+	return p.login(key, login)
+}
+
+// login starts a new backend in a slot that has already been counted.
+func (p *Pool) login(key string, login func() (*Backend, error)) (*Backend, error) {
+	b, err := login()
+	if err != nil {
+		p.release(key)
+		return nil, err
+	}
+
+	b.key = key
+	p.CountConnect()
+	return b, nil
+}
+
+// Put returns a backend to the pool. Backends that are not idle or have
+// exceeded MaxLifetime are closed.
+func (p *Pool) Put(b *Backend) {
+	b.used = time.Now()
+
+	if b.Status != proto.RfqIdle || p.expired(b, b.used) {
+		p.Discard(b)
+		return
+	}
+
+	p.mu.Lock()
+	set := p.sets[b.key]
+
+	if len(set.waiting) > 0 {
+		ready := set.waiting[0]
+		set.waiting = set.waiting[1:]
+		p.mu.Unlock()
+
+		ready <- b
+		return
+	}
+
+	set.idle = append(set.idle, b)
+	p.mu.Unlock()
+}
+
+// Discard closes a backend taken from the pool.
+func (p *Pool) Discard(b *Backend) {
+	p.close(b)
+	p.release(b.key)
+}
+
+func (p *Pool) close(b *Backend) {
+	_ = b.Close()
+	p.CountDisconnect()
+}
+
+// release frees the slot of a backend, handing it to a waiting frontend if
+// there is one.
+func (p *Pool) release(key string) {
+	p.mu.Lock()
+	set := p.sets[key]
+
+	if len(set.waiting) > 0 {
+		ready := set.waiting[0]
+		set.waiting = set.waiting[1:]
+		p.mu.Unlock()
+
+		ready <- nil
+		return
+	}
+
+	set.open--
+	p.mu.Unlock()
+}
+
+// Maintain closes idle backends that exceed MaxIdle or MaxLifetime and starts
+// backends to keep MinSize open for every key that has been used. It returns
+// when ctx is done.
+func (p *Pool) Maintain(ctx context.Context, interval time.Duration) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-tick.C:
+			p.maintain(now)
+		}
+	}
+}
+
+func (p *Pool) maintain(now time.Time) {
+	var closing []*Backend
+	var starting []string
+
+	p.mu.Lock()
+	for key, set := range p.sets {
+		idle := set.idle[:0]
+		for _, b := range set.idle {
+			if p.expired(b, now) ||
+				(p.MaxIdle > 0 && now.Sub(b.used) > p.MaxIdle && set.open > p.MinSize) {
+				closing = append(closing, b)
+				set.open--
+			} else {
+				idle = append(idle, b)
+			}
+		}
+		set.idle = idle
+
+		for ; set.open < p.MinSize && (p.MaxSize <= 0 || set.open < p.MaxSize); set.open++ {
+			starting = append(starting, key)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, b := range closing {
+		p.close(b)
+	}
+
+	for _, key := range starting {
+		p.mu.Lock()
+		login := p.sets[key].login
+		p.mu.Unlock()
+
+		b, err := p.login(key, login)
+		if err != nil {
+			p.Info("msg", "Error starting pooled backend", "error", err)
+			continue
+		}
+		p.Put(b)
+	}
+}
@@ -0,0 +1,182 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+func newTestBackend() *Backend {
+	return &Backend{
+		BackendStream: BackendStream{
+			debug:  func(...interface{}) error { return nil },
+			stream: core.NewBackendStream(nopCloser{bytes.NewBuffer(nil)}),
+		},
+		Status: proto.RfqIdle,
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	t.Parallel()
+
+	var logins, connects, disconnects int
+	pool := Pool{
+		CountConnect:    func() { connects++ },
+		CountDisconnect: func() { disconnects++ },
+	}
+	login := func() (*Backend, error) { logins++; return newTestBackend(), nil }
+
+	b1, err := pool.Get(context.Background(), "a", login)
+	require.NoError(t, err)
+	pool.Put(b1)
+
+	b2, err := pool.Get(context.Background(), "a", login)
+	require.NoError(t, err)
+	assert.True(t, b1 == b2, "Expected the idle backend to be reused")
+
+	b3, err := pool.Get(context.Background(), "b", login)
+	require.NoError(t, err)
+	assert.False(t, b2 == b3, "Expected a different key to start a new backend")
+
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, 2, connects)
+	assert.Equal(t, 0, disconnects)
+
+	t.Run("NotIdle", func(t *testing.T) {
+		b3.Status = proto.RfqInTrans
+		pool.Put(b3)
+		assert.Equal(t, 1, disconnects, "Expected a busy backend to be closed")
+
+		b, err := pool.Get(context.Background(), "b", login)
+		require.NoError(t, err)
+		assert.False(t, b == b3)
+	})
+}
+
+func TestPoolLoginError(t *testing.T) {
+	t.Parallel()
+
+	pool := Pool{MaxSize: 1}
+	_, err := pool.Get(context.Background(), "a", func() (*Backend, error) {
+		return nil, errors.New("nope")
+	})
+	assert.Error(t, err)
+
+	pool.CountConnect = func() {}
+	_, err = pool.Get(context.Background(), "a", func() (*Backend, error) {
+		return newTestBackend(), nil
+	})
+	assert.NoError(t, err, "Expected the failed login to release its slot")
+}
+
+func TestPoolSize(t *testing.T) {
+	t.Parallel()
+
+	pool := Pool{
+		MaxSize: 1,
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+	login := func() (*Backend, error) { return newTestBackend(), nil }
+
+	b1, err := pool.Get(context.Background(), "a", login)
+	require.NoError(t, err)
+
+	t.Run("Timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := pool.Get(ctx, "a", login)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		go func() { time.Sleep(10 * time.Millisecond); pool.Put(b1) }()
+
+		b2, err := pool.Get(context.Background(), "a", login)
+		require.NoError(t, err)
+		assert.True(t, b1 == b2, "Expected the returned backend to be handed over")
+		b1 = b2
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+		go func() { time.Sleep(10 * time.Millisecond); pool.Discard(b1) }()
+
+		b2, err := pool.Get(context.Background(), "a", login)
+		require.NoError(t, err)
+		assert.False(t, b1 == b2, "Expected a new backend in the freed slot")
+	})
+}
+
+func TestPoolMaintain(t *testing.T) {
+	t.Parallel()
+
+	var logins, disconnects int
+	pool := Pool{
+		MinSize:     1,
+		MaxIdle:     time.Minute,
+		MaxLifetime: time.Hour,
+
+		CountConnect:    func() {},
+		CountDisconnect: func() { disconnects++ },
+	}
+	login := func() (*Backend, error) {
+		logins++
+		b := newTestBackend()
+		b.created = time.Now()
+		return b, nil
+	}
+
+	b1, err := pool.Get(context.Background(), "a", login)
+	require.NoError(t, err)
+	b2, err := pool.Get(context.Background(), "a", login)
+	require.NoError(t, err)
+	pool.Put(b1)
+	pool.Put(b2)
+
+	t.Run("MaxIdle", func(t *testing.T) {
+		pool.maintain(time.Now().Add(2 * time.Minute))
+
+		assert.Equal(t, 1, disconnects, "Expected idle backends above MinSize to be closed")
+		assert.Len(t, pool.sets["a"].idle, 1)
+		assert.Equal(t, 1, pool.sets["a"].open)
+	})
+
+	t.Run("MaxLifetime", func(t *testing.T) {
+		pool.maintain(time.Now().Add(2 * time.Hour))
+
+		assert.Equal(t, 2, disconnects, "Expected old backends to be closed")
+		assert.Equal(t, 3, logins, "Expected a new backend to keep MinSize")
+		assert.Len(t, pool.sets["a"].idle, 1)
+		assert.Equal(t, 1, pool.sets["a"].open)
+	})
+}
+
+func TestPoolKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t,
+		poolKey(map[string]string{"user": "mary"}),
+		poolKey(map[string]string{"user": "mary", "database": "mary"}))
+
+	assert.NotEqual(t,
+		poolKey(map[string]string{"user": "mary"}),
+		poolKey(map[string]string{"user": "mary", "database": "other"}))
+
+	assert.NotEqual(t,
+		poolKey(map[string]string{"user": "mary"}),
+		poolKey(map[string]string{"user": "mary", "TimeZone": "UTC"}))
+
+	assert.Equal(t,
+		poolKey(map[string]string{"user": "mary", "application_name": "psql"}),
+		poolKey(map[string]string{"user": "mary", "application_name": "pgbench"}),
+		"Expected application_name to be shared")
+}
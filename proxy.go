@@ -1,17 +1,52 @@
 package pgtwixt
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"sort"
+	"sync"
 
 	"github.com/uhoh-itsmaciek/femebe/core"
 	"github.com/uhoh-itsmaciek/femebe/proto"
 )
 
+const (
+	// PoolSession holds a backend from the pool until the frontend
+	// disconnects.
+	PoolSession = "session"
+
+	// PoolTransaction returns a backend to the pool whenever it reports that
+	// it is idle, between transactions of the frontend.
+	PoolTransaction = "transaction"
+)
+
 type Proxy struct {
 	Info LogFunc
 
+	// Target names the backends in errors sent to frontends, e.g. the Addr
+	// of a Dialer.
+	Target string
+
 	Startup func(map[string]string) (BackendStream, error)
 
+	// When Login is set, the proxy completes startup of each backend itself
+	// rather than passing authentication through to the frontend. Frontends
+	// should be authenticated by the Server.
+	Login func(map[string]string) (*Backend, error)
+
+	// When PoolMode is set, backends are started by Login and shared through
+	// Pool rather than opened for each frontend.
+	PoolMode string
+	Pool     *Pool
+
+	// Cancellations issues the keys sent to frontends in place of the keys
+	// of backends. When it is nil, frontends of their own backends are sent
+	// the keys of those backends and frontends of pooled backends no key.
+	Cancellations *Cancellations
+
 	CountConnect    func()
 	CountDisconnect func()
 }
@@ -45,17 +80,38 @@ func (*Proxy) pump(errc chan<- error, from, to core.Stream) {
 }
 
 func (p *Proxy) Run(fe FrontendStream, startup map[string]string) {
+	if p.PoolMode != "" {
+		p.runPooled(fe, startup)
+		return
+	}
+	if p.Login != nil {
+		p.runLogin(fe, startup)
+		return
+	}
+
 	be, err := p.Startup(startup)
 	if err != nil {
 		p.Info("msg", "Error connecting to backend", "error", err)
+		p.unavailable(fe, err)
 		return
 	}
 	p.CountConnect()
 	defer p.CountDisconnect()
 	defer be.Close()
 
+	var from core.Stream = be
+	if p.Cancellations != nil {
+		ks := &keyedStream{BackendStream: be}
+		if ks.issued, err = p.Cancellations.Issue(ks.cancel); err != nil {
+			p.Info("msg", "Error issuing cancellation key", "error", err)
+			return
+		}
+		defer p.Cancellations.Revoke(ks.issued)
+		from = ks
+	}
+
 	errc := make(chan error, 1)
-	go p.pump(errc, be, fe)
+	go p.pump(errc, from, fe)
 	go p.pump(errc, fe, be)
 
 	err = <-errc
@@ -64,3 +120,514 @@ func (p *Proxy) Run(fe FrontendStream, startup map[string]string) {
 		return
 	}
 }
+
+// runLogin proxies a frontend to a backend of its own that has completed
+// startup through Login.
+func (p *Proxy) runLogin(fe FrontendStream, startup map[string]string) {
+	b, err := p.Login(startup)
+	if err != nil {
+		p.Info("msg", "Error connecting to backend", "error", err)
+		p.unavailable(fe, err)
+		return
+	}
+	p.CountConnect()
+	defer p.CountDisconnect()
+	defer b.Close()
+
+	k, revoke, err := p.issue(func() error { return cancelBackend(b.dialer, b.Key) }, &b.Key)
+	if err != nil {
+		p.Info("msg", "Error issuing cancellation key", "error", err)
+		return
+	}
+	defer revoke()
+
+	if err = p.greet(fe, b, k); err != nil {
+		p.Info("msg", "Error during startup", "error", err)
+		return
+	}
+
+	errc := make(chan error, 1)
+	go p.pump(errc, b.BackendStream, fe)
+	go p.pump(errc, fe, b.BackendStream)
+
+	err = <-errc
+	if err != nil && err != io.EOF {
+		p.Info("msg", "Error while proxying", "error", err)
+		return
+	}
+}
+
+// unavailable tells a frontend why it could not be connected to a backend. An
+// ErrorResponse from the backend is passed along as it is.
+func (p *Proxy) unavailable(fe FrontendStream, err error) {
+	var e ErrorResponse
+	if !errors.As(err, &e) {
+		// Distinguish a backend that cannot be reached from one that fails
+		// after it is reached.
+		code := "08006" // connection_failure
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" || errors.Is(err, context.DeadlineExceeded) {
+			code = "08001" // sqlclient_unable_to_establish_sqlconnection
+		}
+
+		target := "backend"
+		if p.Target != "" {
+			target = fmt.Sprintf("backend %q", p.Target)
+		}
+		e = ErrorResponse{Fields: map[byte]string{
+			'S': "FATAL", 'V': "FATAL", 'C': code,
+			'M': fmt.Sprintf("pgtwixt could not connect to %s: %v", target, err),
+		}}
+	}
+
+	var msg core.Message
+	initErrorResponse(&msg, e)
+	if fe.Send(&msg) == nil {
+		_ = fe.Flush()
+	}
+}
+
+// keyedStream replaces the BackendKeyData sent by a backend with the key
+// issued to its frontend.
+type keyedStream struct {
+	BackendStream
+	issued CancellationKey
+
+	mu      sync.Mutex
+	backend *CancellationKey
+}
+
+func (ks *keyedStream) Next(m *core.Message) error {
+	err := ks.BackendStream.Next(m)
+	if err == nil && m.MsgType() == proto.MsgBackendKeyDataK {
+		var k CancellationKey
+		if k, err = readBackendKeyData(m); err == nil {
+			ks.mu.Lock()
+			ks.backend = &k
+			ks.mu.Unlock()
+
+			initBackendKeyData(m, ks.issued)
+		}
+	}
+	return err
+}
+
+func (ks *keyedStream) cancel() error {
+	ks.mu.Lock()
+	k := ks.backend
+	ks.mu.Unlock()
+
+	if k == nil {
+		return errors.New("backend has not sent its cancellation key")
+	}
+	return cancelBackend(ks.dialer, *k)
+}
+
+// issue returns a key that calls cancel through Cancellations and a function
+// that revokes it. Without Cancellations, it returns fallback.
+func (p *Proxy) issue(cancel func() error, fallback *CancellationKey) (*CancellationKey, func(), error) {
+	if p.Cancellations == nil {
+		return fallback, func() {}, nil
+	}
+	k, err := p.Cancellations.Issue(cancel)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &k, func() { p.Cancellations.Revoke(k) }, nil
+}
+
+// greet completes the startup of a frontend using the parameters reported by a
+// pooled backend and the key issued to the frontend, if any.
+func (*Proxy) greet(fe FrontendStream, b *Backend, k *CancellationKey) error {
+	var msg core.Message
+
+	proto.InitAuthenticationOk(&msg)
+	if err := fe.Send(&msg); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(b.Parameters))
+	for name := range b.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		initParameterStatus(&msg, name, b.Parameters[name])
+		if err := fe.Send(&msg); err != nil {
+			return err
+		}
+	}
+
+	if k != nil {
+		initBackendKeyData(&msg, *k)
+		if err := fe.Send(&msg); err != nil {
+			return err
+		}
+	}
+
+	proto.InitReadyForQuery(&msg, proto.RfqIdle)
+	if err := fe.Send(&msg); err != nil {
+		return err
+	}
+
+	return fe.Flush()
+}
+
+// unpooledParameters are startup parameters that do not change the state of a
+// session, so backends started with different values can be shared.
+var unpooledParameters = map[string]bool{
+	"application_name": true,
+}
+
+// poolKey identifies the backends that can serve a frontend: those started
+// for the same user and database with the same session parameters.
+func poolKey(startup map[string]string) string {
+	params := make(map[string]string, len(startup)+1)
+	for name, value := range startup {
+		if !unpooledParameters[name] {
+			params[name] = value
+		}
+	}
+	if params["database"] == "" {
+		params["database"] = params["user"]
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key []byte
+	for _, name := range names {
+		key = append(key, name...)
+		key = append(key, 0)
+		key = append(key, params[name]...)
+		key = append(key, 0)
+	}
+	return string(key)
+}
+
+func (p *Proxy) runPooled(fe FrontendStream, startup map[string]string) {
+	s := pooledSession{
+		proxy:   p,
+		fe:      fe,
+		errc:    make(chan error, 1),
+		key:     poolKey(startup),
+		login:   func() (*Backend, error) { return p.Login(startup) },
+		session: p.PoolMode == PoolSession,
+	}
+	s.sendc = sync.NewCond(&s.mu)
+
+	// The key of a shared backend would cancel the queries of other
+	// frontends, so there is none without Cancellations.
+	k, revoke, err := p.issue(s.cancel, nil)
+	if err != nil {
+		p.Info("msg", "Error issuing cancellation key", "error", err)
+		return
+	}
+	defer revoke()
+
+	b, err := p.Pool.Get(context.Background(), s.key, s.login)
+	if err != nil {
+		p.Info("msg", "Error connecting to backend", "error", err)
+		p.unavailable(fe, err)
+		return
+	}
+	err = p.greet(fe, b, k)
+	if s.session {
+		s.attached(b)
+	} else {
+		p.Pool.Put(b)
+	}
+	if err != nil {
+		p.Info("msg", "Error during startup", "error", err)
+		s.finish()
+		return
+	}
+
+	if err = s.run(); err != nil && err != io.EOF {
+		p.Info("msg", "Error while proxying", "error", err)
+	}
+}
+
+// pooledSession proxies a frontend that borrows a backend from the pool for
+// each of its transactions or for the whole session.
+type pooledSession struct {
+	proxy   *Proxy
+	fe      FrontendStream
+	errc    chan error
+	key     string
+	login   func() (*Backend, error)
+	session bool
+
+	mu      sync.Mutex
+	be      *Backend
+	pending int  // Query, FunctionCall, and Sync messages without ReadyForQuery
+	partial bool // extended query messages since the last Sync
+	sending bool // a message is on its way to the backend
+	sendc   *sync.Cond
+	closing bool // the frontend is gone
+	failed  bool // an error was reported after the frontend was gone
+}
+
+// idle reports whether the backend can be returned to the pool. The caller
+// must hold the lock.
+func (s *pooledSession) idle() bool {
+	return s.be.Status == proto.RfqIdle && s.pending == 0 && !s.partial
+}
+
+// cancel sends a CancelRequest to the backend that is attached, if any. The
+// backend is dialed without the lock so that a slow one does not stall the
+// session; like any CancelRequest, it may arrive after the query is done.
+func (s *pooledSession) cancel() error {
+	s.mu.Lock()
+	b := s.be
+	s.mu.Unlock()
+
+	if b == nil {
+		return nil
+	}
+	return cancelBackend(b.dialer, b.Key)
+}
+
+// attached starts copying messages from a backend to the frontend.
+func (s *pooledSession) attached(b *Backend) {
+	s.mu.Lock()
+	s.be = b
+	s.mu.Unlock()
+
+	go s.pump(b)
+}
+
+// attach returns the backend of the current transaction, taking one from the
+// pool when necessary, and records a message that is about to be sent to it.
+// The lock is not held while waiting on the pool so that a full pool does not
+// block cancel.
+func (s *pooledSession) attach(msgType byte) (*Backend, error) {
+	s.mu.Lock()
+	for s.be == nil {
+		s.mu.Unlock()
+
+		b, err := s.proxy.Pool.Get(context.Background(), s.key, s.login)
+		if err != nil {
+			return nil, err
+		}
+		s.attached(b)
+
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+
+	switch msgType {
+	case proto.MsgQueryQ, proto.MsgFunctionCallF:
+		s.pending++
+	case proto.MsgSyncS:
+		s.pending++
+		s.partial = false
+	case proto.MsgParseP, proto.MsgBindB, proto.MsgExecuteE,
+		proto.MsgDescribeD, proto.MsgCloseC, proto.MsgFlushH:
+		s.partial = true
+	}
+
+	s.sending = true
+	return s.be, nil
+}
+
+// sent records that a message has reached the backend.
+func (s *pooledSession) sent() {
+	s.mu.Lock()
+	s.sending = false
+	s.sendc.Broadcast()
+	s.mu.Unlock()
+}
+
+// finish returns or closes the backend that is attached when the frontend is
+// gone. A backend that is idle is sent Pool.Reset, or a Sync when there is no
+// reset, so that its pump stops at the next ReadyForQuery.
+func (s *pooledSession) finish() {
+	var msg core.Message
+
+	s.mu.Lock()
+	b := s.be
+	if b == nil {
+		s.mu.Unlock()
+		return
+	}
+	if !s.idle() {
+		s.be = nil
+		s.mu.Unlock()
+
+		// The backend is in the middle of a transaction.
+		s.proxy.Pool.Discard(b)
+		return
+	}
+	// The pump cannot release the backend before the response to this arrives.
+	s.closing = true
+	s.pending++
+	s.mu.Unlock()
+
+	if s.proxy.Pool.Reset != "" {
+		proto.InitQuery(&msg, s.proxy.Pool.Reset)
+	} else {
+		msg.InitFromBytes(proto.MsgSyncS, nil)
+	}
+
+	err := b.Send(&msg)
+	if err == nil {
+		err = b.Flush()
+	}
+
+	if err != nil {
+		s.mu.Lock()
+		owned := s.be == b
+		if owned {
+			s.be = nil
+		}
+		s.mu.Unlock()
+
+		if owned {
+			s.proxy.Pool.Discard(b)
+		}
+	}
+}
+
+// pump copies messages from a backend to the frontend until the backend is
+// idle and returned to the pool.
+func (s *pooledSession) pump(b *Backend) {
+	var msg core.Message
+	var err error
+
+	for {
+		if err = b.Next(&msg); err != nil {
+			break
+		}
+
+		var status proto.ConnStatus
+		if msg.MsgType() == proto.MsgReadyForQueryZ {
+			if status, err = readReadyForQuery(&msg); err != nil {
+				break
+			}
+		}
+
+		s.mu.Lock()
+		if msg.MsgType() == proto.MsgReadyForQueryZ {
+			if s.be != b {
+				s.mu.Unlock()
+				return
+			}
+
+			// Record the status before the frontend sees it and moves on.
+			b.Status = status
+			if s.pending > 0 {
+				s.pending--
+			}
+		}
+		closing := s.closing
+		if closing && msg.MsgType() == proto.MsgErrorResponseE {
+			s.failed = true
+		}
+		s.mu.Unlock()
+
+		if closing {
+			if err = msg.Discard(); err != nil {
+				break
+			}
+		} else {
+			if err = s.fe.Send(&msg); err != nil {
+				break
+			}
+			if !b.HasNext() {
+				if err = s.fe.Flush(); err != nil {
+					break
+				}
+			}
+		}
+
+		if msg.MsgType() == proto.MsgReadyForQueryZ {
+			s.mu.Lock()
+
+			// Messages that do not expect a response, like CopyDone, may
+			// still be on their way.
+			for s.sending && s.be == b {
+				s.sendc.Wait()
+			}
+
+			release := s.be == b && s.idle() && !b.HasNext() && (s.closing || !s.session)
+			failed := s.failed
+			if release {
+				s.be = nil
+			}
+			s.mu.Unlock()
+
+			if release && failed {
+				s.proxy.Pool.Discard(b)
+				return
+			}
+			if release {
+				s.proxy.Pool.Put(b)
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	owned := s.be == b
+	if owned {
+		s.be = nil
+	}
+	s.mu.Unlock()
+
+	if owned {
+		s.proxy.Pool.Discard(b)
+
+		select {
+		case s.errc <- err:
+		default:
+		}
+		_ = s.fe.Close()
+	}
+}
+
+// run copies messages from the frontend to backends until the frontend
+// terminates.
+func (s *pooledSession) run() error {
+	var msg core.Message
+	var err error
+
+	for {
+		if err = s.fe.Next(&msg); err != nil {
+			break
+		}
+		if msg.MsgType() == proto.MsgTerminateX {
+			err = msg.Discard()
+			break
+		}
+
+		var b *Backend
+		if b, err = s.attach(msg.MsgType()); err != nil {
+			break
+		}
+		if err = b.Send(&msg); err == nil && !s.fe.HasNext() {
+			err = b.Flush()
+		}
+		s.sent()
+
+		if err != nil {
+			break
+		}
+	}
+
+	s.finish()
+
+	select {
+	case perr := <-s.errc:
+		if perr != nil && perr != io.EOF {
+			err = perr
+		}
+	default:
+	}
+
+	return err
+}
@@ -0,0 +1,541 @@
+package pgtwixt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+func TestProxyCancellationKey(t *testing.T) {
+	t.Parallel()
+
+	nop := func(...interface{}) error { return nil }
+	beConn, server := net.Pipe()
+	conn, client := net.Pipe()
+	defer server.Close()
+
+	var dialer cancelDialer
+	cancels := new(Cancellations)
+	proxy := Proxy{
+		Info: nop,
+		Startup: func(map[string]string) (BackendStream, error) {
+			return BackendStream{debug: nop, stream: core.NewBackendStream(beConn), dialer: &dialer}, nil
+		},
+		Cancellations: cancels,
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		proxy.Run(FrontendStream{debug: nop, stream: core.NewBackendStream(conn)}, nil)
+	}()
+
+	var msg, k core.Message
+	initBackendKeyData(&k, CancellationKey{id: 2600, secret: 1957})
+	go func() { _ = core.NewBackendStream(server).Send(&k) }()
+
+	fe := core.NewBackendStream(client)
+	require.NoError(t, fe.Next(&msg))
+	issued, err := readBackendKeyData(&msg)
+	require.NoError(t, err)
+	assert.NotEqual(t, CancellationKey{id: 2600, secret: 1957}, issued,
+		"Expected the key of the backend to be replaced")
+
+	assert.Error(t, cancels.Cancel(CancellationKey{id: 2600, secret: 1957}))
+	assert.NoError(t, cancels.Cancel(issued))
+	assert.Equal(t, CancellationKey{id: 2600, secret: 1957}, dialer.key(t),
+		"Expected the issued key to cancel the backend")
+
+	client.Close()
+	<-done
+
+	assert.Error(t, cancels.Cancel(issued), "Expected the key to be revoked")
+}
+
+func TestProxyWithoutCancellations(t *testing.T) {
+	t.Parallel()
+
+	nop := func(...interface{}) error { return nil }
+	backend := CancellationKey{id: 2600, secret: 1957}
+
+	run := func(t *testing.T, proxy Proxy, server net.Conn) *core.MessageStream {
+		conn, client := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+
+		go func() {
+			defer conn.Close()
+			proxy.Run(FrontendStream{debug: nop, stream: core.NewBackendStream(conn)},
+				map[string]string{"user": "mary"})
+		}()
+		return core.NewBackendStream(client)
+	}
+
+	t.Run("Startup", func(t *testing.T) {
+		beConn, server := net.Pipe()
+		defer server.Close()
+
+		fe := run(t, Proxy{
+			Info: nop,
+			Startup: func(map[string]string) (BackendStream, error) {
+				return BackendStream{debug: nop, stream: core.NewBackendStream(beConn)}, nil
+			},
+			CountConnect:    func() {},
+			CountDisconnect: func() {},
+		}, server)
+
+		var msg, k core.Message
+		initBackendKeyData(&k, backend)
+		go func() { _ = core.NewBackendStream(server).Send(&k) }()
+
+		require.NoError(t, fe.Next(&msg))
+		key, err := readBackendKeyData(&msg)
+		require.NoError(t, err)
+		assert.Equal(t, backend, key, "Expected the key of the backend")
+	})
+
+	t.Run("Login", func(t *testing.T) {
+		beConn, server := net.Pipe()
+		defer server.Close()
+
+		fe := run(t, Proxy{
+			Info: nop,
+			Login: func(map[string]string) (*Backend, error) {
+				return &Backend{
+					BackendStream: BackendStream{debug: nop, stream: core.NewBackendStream(beConn)},
+					Key:           backend,
+					Status:        proto.RfqIdle,
+				}, nil
+			},
+			CountConnect:    func() {},
+			CountDisconnect: func() {},
+		}, server)
+
+		var msg core.Message
+		require.NoError(t, fe.Next(&msg))
+		require.Equal(t, byte(proto.MsgAuthenticationOkR), msg.MsgType())
+		require.NoError(t, msg.Discard())
+
+		require.NoError(t, fe.Next(&msg))
+		require.Equal(t, byte(proto.MsgBackendKeyDataK), msg.MsgType())
+		key, err := readBackendKeyData(&msg)
+		require.NoError(t, err)
+		assert.Equal(t, backend, key, "Expected the key of the backend")
+	})
+
+	t.Run("Pooled", func(t *testing.T) {
+		beConn, server := net.Pipe()
+		defer server.Close()
+
+		fe := run(t, Proxy{
+			Info:     nop,
+			PoolMode: PoolTransaction,
+			Pool: &Pool{
+				MaxSize: 1,
+
+				CountConnect:    func() {},
+				CountDisconnect: func() {},
+			},
+			Login: func(map[string]string) (*Backend, error) {
+				return &Backend{
+					BackendStream: BackendStream{debug: nop, stream: core.NewBackendStream(beConn)},
+					Key:           backend,
+					Status:        proto.RfqIdle,
+				}, nil
+			},
+			CountConnect:    func() {},
+			CountDisconnect: func() {},
+		}, server)
+
+		var msg core.Message
+		require.NoError(t, fe.Next(&msg))
+		require.Equal(t, byte(proto.MsgAuthenticationOkR), msg.MsgType())
+		require.NoError(t, msg.Discard())
+
+		require.NoError(t, fe.Next(&msg))
+		assert.Equal(t, byte(proto.MsgReadyForQueryZ), msg.MsgType(),
+			"Expected no key of a shared backend")
+		require.NoError(t, msg.Discard())
+	})
+}
+
+// stallDialer blocks in Dial until it is released.
+type stallDialer struct{ dialing, release chan struct{} }
+
+func (*stallDialer) Addr() string { return "stall" }
+
+func (d *stallDialer) Dial(ctx context.Context) (BackendStream, error) {
+	close(d.dialing)
+	<-d.release
+	return BackendStream{}, errors.New("stalled")
+}
+
+func TestPooledSessionCancel(t *testing.T) {
+	t.Parallel()
+
+	dialer := &stallDialer{dialing: make(chan struct{}), release: make(chan struct{})}
+	s := pooledSession{be: &Backend{BackendStream: BackendStream{dialer: dialer}}}
+
+	cancelled := make(chan error, 1)
+	go func() { cancelled <- s.cancel() }()
+	<-dialer.dialing
+
+	locked := make(chan struct{})
+	go func() { s.mu.Lock(); s.mu.Unlock(); close(locked) }()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to be unlocked while dialing")
+	}
+
+	close(dialer.release)
+	assert.EqualError(t, <-cancelled, "stalled")
+}
+
+func TestPooledSessionAttach(t *testing.T) {
+	t.Parallel()
+
+	logging, release := make(chan struct{}), make(chan struct{})
+	s := pooledSession{
+		proxy: &Proxy{Pool: &Pool{}},
+		key:   "k",
+		login: func() (*Backend, error) {
+			close(logging)
+			<-release
+			return nil, errors.New("stalled")
+		},
+	}
+	s.sendc = sync.NewCond(&s.mu)
+
+	attached := make(chan error, 1)
+	go func() { _, err := s.attach(byte(proto.MsgQueryQ)); attached <- err }()
+	<-logging
+
+	locked := make(chan struct{})
+	go func() { s.mu.Lock(); s.mu.Unlock(); close(locked) }()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to be unlocked while waiting on the pool")
+	}
+
+	close(release)
+	assert.EqualError(t, <-attached, "stalled")
+}
+
+func TestProxyLogin(t *testing.T) {
+	t.Parallel()
+
+	nop := func(...interface{}) error { return nil }
+	beConn, server := net.Pipe()
+	conn, client := net.Pipe()
+	defer server.Close()
+
+	var dialer cancelDialer
+	cancels := new(Cancellations)
+	proxy := Proxy{
+		Info: nop,
+		Login: func(startup map[string]string) (*Backend, error) {
+			assert.Equal(t, map[string]string{"user": "mary"}, startup)
+			return &Backend{
+				BackendStream: BackendStream{debug: nop, stream: core.NewBackendStream(beConn), dialer: &dialer},
+				Key:           CancellationKey{id: 2600, secret: 1957},
+				Parameters:    map[string]string{"server_version": "11"},
+				Status:        proto.RfqIdle,
+			}, nil
+		},
+		Cancellations: cancels,
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		proxy.Run(FrontendStream{debug: nop, stream: core.NewBackendStream(conn)},
+			map[string]string{"user": "mary"})
+	}()
+
+	be := core.NewBackendStream(server)
+	fe := core.NewBackendStream(client)
+
+	var msg core.Message
+	expect := func(s *core.MessageStream, msgType byte) {
+		require.NoError(t, s.Next(&msg))
+		require.Equal(t, string(msgType), string(msg.MsgType()))
+	}
+
+	expect(fe, proto.MsgAuthenticationOkR)
+	require.NoError(t, msg.Discard())
+	expect(fe, proto.MsgParameterStatusS)
+	require.NoError(t, msg.Discard())
+	expect(fe, proto.MsgBackendKeyDataK)
+	issued, err := readBackendKeyData(&msg)
+	require.NoError(t, err)
+	expect(fe, proto.MsgReadyForQueryZ)
+	require.NoError(t, msg.Discard())
+
+	var q core.Message
+	proto.InitQuery(&q, "SELECT 1")
+	go func() { _ = fe.Send(&q); _ = fe.Flush() }()
+	expect(be, proto.MsgQueryQ)
+	require.NoError(t, msg.Discard())
+
+	require.NoError(t, cancels.Cancel(issued))
+	assert.Equal(t, CancellationKey{id: 2600, secret: 1957}, dialer.key(t),
+		"Expected the issued key to cancel the backend")
+
+	client.Close()
+	<-done
+}
+
+func TestProxyTransaction(t *testing.T) {
+	t.Parallel()
+
+	nop := func(...interface{}) error { return nil }
+	beConn, server := net.Pipe()
+	defer server.Close()
+
+	var logins int
+	proxy := Proxy{
+		Info:     nop,
+		PoolMode: PoolTransaction,
+
+		Cancellations: new(Cancellations),
+		Pool: &Pool{
+			MaxSize: 1,
+
+			CountConnect:    func() {},
+			CountDisconnect: func() {},
+		},
+		Login: func(startup map[string]string) (*Backend, error) {
+			logins++
+			assert.Equal(t, map[string]string{"user": "mary"}, startup)
+			return &Backend{
+				BackendStream: BackendStream{debug: nop, stream: core.NewBackendStream(beConn)},
+				Parameters:    map[string]string{"server_version": "11"},
+				Status:        proto.RfqIdle,
+			}, nil
+		},
+	}
+
+	// The frontend stream is past startup, which is the initial state of a
+	// backend stream.
+	be := core.NewBackendStream(server)
+	run := func() (*core.MessageStream, chan struct{}) {
+		conn, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer conn.Close()
+			proxy.Run(FrontendStream{debug: nop, stream: core.NewBackendStream(conn)},
+				map[string]string{"user": "mary"})
+		}()
+		return core.NewBackendStream(client), done
+	}
+
+	expect := func(s *core.MessageStream, msgType byte) {
+		var msg core.Message
+		require.NoError(t, s.Next(&msg))
+		require.Equal(t, string(msgType), string(msg.MsgType()))
+		require.NoError(t, msg.Discard())
+	}
+	query := func(fe *core.MessageStream, status proto.ConnStatus) {
+		var q, z core.Message
+		proto.InitQuery(&q, "SELECT 1")
+		go func() { _ = fe.Send(&q) }()
+		expect(be, proto.MsgQueryQ)
+
+		proto.InitReadyForQuery(&z, status)
+		go func() { _ = be.Send(&z) }()
+		expect(fe, proto.MsgReadyForQueryZ)
+	}
+	terminate := func(fe *core.MessageStream, done chan struct{}) {
+		var x core.Message
+		x.InitFromBytes(proto.MsgTerminateX, nil)
+		_ = fe.Send(&x) // the proxy closes as soon as it reads Terminate
+		<-done
+	}
+
+	fe1, done1 := run()
+	expect(fe1, proto.MsgAuthenticationOkR)
+	expect(fe1, proto.MsgParameterStatusS)
+	expect(fe1, proto.MsgBackendKeyDataK)
+	expect(fe1, proto.MsgReadyForQueryZ)
+
+	query(fe1, proto.RfqInTrans)
+	query(fe1, proto.RfqIdle)
+
+	// The pool holds only one backend, so the second frontend can start only
+	// after the first has finished its transaction.
+	fe2, done2 := run()
+	expect(fe2, proto.MsgAuthenticationOkR)
+	expect(fe2, proto.MsgParameterStatusS)
+	expect(fe2, proto.MsgBackendKeyDataK)
+	expect(fe2, proto.MsgReadyForQueryZ)
+
+	query(fe2, proto.RfqIdle)
+	query(fe1, proto.RfqIdle)
+
+	// The proxy may Sync a backend that is still attached when its frontend
+	// disconnects.
+	go func() {
+		var msg, z core.Message
+		proto.InitReadyForQuery(&z, proto.RfqIdle)
+		for be.Next(&msg) == nil && msg.Discard() == nil && be.Send(&z) == nil {
+		}
+	}()
+
+	terminate(fe1, done1)
+	terminate(fe2, done2)
+
+	assert.Equal(t, 1, logins, "Expected the backend to be shared between frontends")
+}
+
+func TestProxySession(t *testing.T) {
+	t.Parallel()
+
+	nop := func(...interface{}) error { return nil }
+	beConn, server := net.Pipe()
+	conn, client := net.Pipe()
+	defer server.Close()
+
+	var logins int
+	pool := &Pool{
+		MaxSize: 1,
+		Reset:   "DISCARD ALL",
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+	proxy := Proxy{
+		Info:     nop,
+		PoolMode: PoolSession,
+
+		Cancellations: new(Cancellations),
+		Pool:          pool,
+		Login: func(startup map[string]string) (*Backend, error) {
+			logins++
+			return &Backend{
+				BackendStream: BackendStream{debug: nop, stream: core.NewBackendStream(beConn)},
+				Status:        proto.RfqIdle,
+			}, nil
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		proxy.Run(FrontendStream{debug: nop, stream: core.NewBackendStream(conn)},
+			map[string]string{"user": "mary"})
+	}()
+
+	be := core.NewBackendStream(server)
+	fe := core.NewBackendStream(client)
+
+	expect := func(s *core.MessageStream, msgType byte) string {
+		var msg core.Message
+		require.NoError(t, s.Next(&msg))
+		require.Equal(t, string(msgType), string(msg.MsgType()))
+		b, err := msg.Force()
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	expect(fe, proto.MsgAuthenticationOkR)
+	expect(fe, proto.MsgBackendKeyDataK)
+	expect(fe, proto.MsgReadyForQueryZ)
+
+	var q, z, x core.Message
+	proto.InitQuery(&q, "SET search_path = x")
+	go func() { _ = fe.Send(&q) }()
+	expect(be, proto.MsgQueryQ)
+
+	proto.InitReadyForQuery(&z, proto.RfqIdle)
+	go func() { _ = be.Send(&z) }()
+	expect(fe, proto.MsgReadyForQueryZ)
+
+	x.InitFromBytes(proto.MsgTerminateX, nil)
+	go func() { _ = fe.Send(&x) }()
+
+	// The backend stays with the session until it disconnects, then is reset.
+	assert.Equal(t, "DISCARD ALL\x00", expect(be, proto.MsgQueryQ))
+	require.NoError(t, be.Send(&z))
+	<-done
+
+	// The pool holds only one backend, so this waits for it to be returned.
+	b, err := pool.Get(context.Background(), poolKey(map[string]string{"user": "mary"}), nil)
+	require.NoError(t, err)
+	assert.NotNil(t, b)
+	assert.Equal(t, 1, logins)
+}
+
+func TestProxyUnavailable(t *testing.T) {
+	t.Parallel()
+
+	nop := func(...interface{}) error { return nil }
+
+	// run returns the error sent to a frontend when Login fails with err.
+	run := func(t *testing.T, err error) ErrorResponse {
+		conn, client := net.Pipe()
+		defer client.Close()
+
+		proxy := Proxy{
+			Info:   nop,
+			Target: "db.example:5432",
+			Login:  func(map[string]string) (*Backend, error) { return nil, err },
+		}
+		go func() {
+			defer conn.Close()
+			proxy.Run(FrontendStream{debug: nop, stream: core.NewBackendStream(conn)}, nil)
+		}()
+
+		var msg core.Message
+		require.NoError(t, core.NewBackendStream(client).Next(&msg))
+		require.Equal(t, byte(proto.MsgErrorResponseE), msg.MsgType())
+
+		e, ok := readErrorResponse(&msg).(ErrorResponse)
+		require.True(t, ok)
+		return e
+	}
+
+	t.Run("Unreachable", func(t *testing.T) {
+		e := run(t, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+		assert.Equal(t, "08001", e.Fields['C'])
+		assert.Equal(t, "FATAL", e.Fields['S'])
+		assert.Contains(t, e.Fields['M'], "pgtwixt")
+		assert.Contains(t, e.Fields['M'], `"db.example:5432"`)
+		assert.Contains(t, e.Fields['M'], "connection refused")
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		e := run(t, io.ErrUnexpectedEOF)
+		assert.Equal(t, "08006", e.Fields['C'])
+		assert.Contains(t, e.Fields['M'], "unexpected EOF")
+	})
+
+	t.Run("Backend", func(t *testing.T) {
+		e := run(t, ErrorResponse{Fields: map[byte]string{
+			'S': "FATAL", 'C': "3D000", 'M': `database "nope" does not exist`,
+		}})
+		assert.Equal(t, "3D000", e.Fields['C'], "Expected the error of the backend")
+		assert.Equal(t, `database "nope" does not exist`, e.Fields['M'])
+	})
+}
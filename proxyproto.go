@@ -0,0 +1,168 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature begins a PROXY protocol header of version 2.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose addresses were reported by a PROXY protocol
+// header. Bytes read while looking for a header are read again through r.
+type proxyConn struct {
+	net.Conn
+	r             io.Reader
+	local, remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header of version 1 or 2 from conn.
+// It returns conn with the addresses in the header and whether there was a
+// header. A frontend never begins with either version because the first byte
+// of a startup packet is the high byte of its length.
+func readProxyHeader(conn net.Conn) (net.Conn, bool, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return conn, false, err
+	}
+
+	pc := &proxyConn{Conn: conn, r: conn}
+	var err error
+
+	switch first[0] {
+	case 'P':
+		err = pc.readV1()
+	case proxyV2Signature[0]:
+		err = pc.readV2()
+	default:
+		pc.r = io.MultiReader(bytes.NewReader(first), conn)
+		return pc, false, nil
+	}
+	if err != nil {
+		return conn, false, fmt.Errorf("invalid PROXY protocol header: %w", err)
+	}
+	return pc, true, nil
+}
+
+// readV1 reads the rest of a human-readable header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n".
+func (c *proxyConn) readV1() error {
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		// The longest header is 107 bytes.
+		if len(line) >= 107 {
+			return errors.New("header is too long")
+		}
+		if _, err := io.ReadFull(c.Conn, b); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return fmt.Errorf("malformed header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("malformed header %q", line)
+	}
+
+	addr := func(host, port string) (*net.TCPAddr, error) {
+		ip := net.ParseIP(host)
+		p, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("malformed address %q", net.JoinHostPort(host, port))
+		}
+		return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+	}
+
+	remote, err := addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	local, err := addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = remote, local
+	return nil
+}
+
+// readV2 reads the rest of a binary header.
+func (c *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	header[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(c.Conn, header[1:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return errors.New("malformed signature")
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.Conn, body); err != nil {
+		return err
+	}
+
+	// The LOCAL command is sent by the proxy itself, e.g. for health checks.
+	switch header[12] & 0xF {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("unsupported command %d", header[12]&0xF)
+	}
+
+	// Addresses other than TCP over IPv4 and IPv6 are ignored, as are TLVs.
+	var size int
+	switch header[13] {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return fmt.Errorf("addresses are too short: %d", len(body))
+	}
+
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:size]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package pgtwixt
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	v2 := func(command, family byte, addresses ...byte) []byte {
+		b := append([]byte(nil), proxyV2Signature...)
+		b = append(b, 0x20|command, family, 0, byte(len(addresses)))
+		return append(b, addresses...)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		header string
+		found  bool
+		remote string
+		local  string
+		err    string
+	}{
+		{name: "None", header: "", found: false},
+		{
+			name: "V1,TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n", found: true,
+			remote: "192.0.2.1:56324", local: "198.51.100.1:5432",
+		},
+		{
+			name: "V1,TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 5432\r\n", found: true,
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:5432",
+		},
+		{name: "V1,UNKNOWN", header: "PROXY UNKNOWN\r\n", found: true},
+		{
+			name: "V1,Malformed", header: "PROXY TCP4 192.0.2.1\r\n",
+			err: `invalid PROXY protocol header: malformed header "PROXY TCP4 192.0.2.1\r\n"`,
+		},
+		{
+			name: "V1,Address", header: "PROXY TCP4 192.0.2.1 nope 56324 5432\r\n",
+			err: `invalid PROXY protocol header: malformed address "nope:5432"`,
+		},
+		{
+			name: "V2,TCP4", found: true,
+			header: string(v2(1, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x15, 0x38)),
+			remote: "192.0.2.1:56324", local: "198.51.100.1:5432",
+		},
+		{
+			name: "V2,TCP6", found: true,
+			header: string(v2(1, 0x21,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0xdc, 0x04, 0x15, 0x38)),
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:5432",
+		},
+		{name: "V2,LOCAL", header: string(v2(0, 0)), found: true},
+		{
+			name: "V2,Short", header: string(v2(1, 0x11, 192, 0, 2, 1)),
+			err: "invalid PROXY protocol header: addresses are too short: 4",
+		},
+		{
+			name: "V2,Signature", header: "\r\n\r\n\x00\r\nQUIT!\x21\x11\x00\x00",
+			err: "invalid PROXY protocol header: malformed signature",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			conn, client := net.Pipe()
+			defer conn.Close()
+			go func() {
+				defer client.Close()
+				_, _ = client.Write([]byte(tt.header + "\x00rest"))
+			}()
+
+			pc, found, err := readProxyHeader(conn)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.found, found)
+
+			remote, local := conn.RemoteAddr().String(), conn.LocalAddr().String()
+			if tt.remote != "" {
+				remote, local = tt.remote, tt.local
+			}
+			assert.Equal(t, remote, pc.RemoteAddr().String())
+			assert.Equal(t, local, pc.LocalAddr().String())
+
+			rest := make([]byte, 5)
+			_, err = io.ReadFull(pc, rest)
+			require.NoError(t, err)
+			assert.Equal(t, "\x00rest", string(rest), "Expected the frontend to follow the header")
+		})
+	}
+}
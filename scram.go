@@ -0,0 +1,238 @@
+package pgtwixt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// https://www.postgresql.org/docs/current/sasl-authentication.html
+// https://tools.ietf.org/html/rfc5802
+
+const (
+	scramSHA256     = "SCRAM-SHA-256"
+	scramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// scramSecret is the verifier that PostgreSQL stores for a SCRAM password:
+// "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>".
+type scramSecret struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func parseSCRAMSecret(s string) (scramSecret, error) {
+	var v scramSecret
+	var err error
+
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != scramSHA256 {
+		return v, fmt.Errorf("invalid SCRAM secret")
+	}
+
+	ps := strings.SplitN(parts[1], ":", 2)
+	ks := strings.SplitN(parts[2], ":", 2)
+	if len(ps) != 2 || len(ks) != 2 {
+		return v, fmt.Errorf("invalid SCRAM secret")
+	}
+
+	if v.iterations, err = strconv.Atoi(ps[0]); err == nil {
+		v.salt, err = base64.StdEncoding.DecodeString(ps[1])
+	}
+	if err == nil {
+		v.storedKey, err = base64.StdEncoding.DecodeString(ks[0])
+	}
+	if err == nil {
+		v.serverKey, err = base64.StdEncoding.DecodeString(ks[1])
+	}
+	return v, err
+}
+
+// newSCRAMSecret derives a verifier from a password using a random salt.
+func newSCRAMSecret(password string, iterations int) (scramSecret, error) {
+	v := scramSecret{iterations: iterations, salt: make([]byte, 16)}
+	if _, err := rand.Read(v.salt); err != nil {
+		return v, err
+	}
+
+	salted := scramSaltedPassword(password, v.salt, v.iterations)
+	v.storedKey = scramHash(scramHMAC(salted, "Client Key"))
+	v.serverKey = scramHMAC(salted, "Server Key")
+	return v, nil
+}
+
+func (v scramSecret) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s", scramSHA256, v.iterations,
+		base64.StdEncoding.EncodeToString(v.salt),
+		base64.StdEncoding.EncodeToString(v.storedKey),
+		base64.StdEncoding.EncodeToString(v.serverKey))
+}
+
+// scramSaltedPassword is Hi() of RFC 5802, which is PBKDF2 with HMAC-SHA-256.
+// Passwords are not normalized with SASLprep.
+func scramSaltedPassword(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func scramHash(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	_, err := rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b), err
+}
+
+// scramAttributes splits a SCRAM message into its attributes, e.g. "r=abc,s=def".
+func scramAttributes(s string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, a := range strings.Split(s, ",") {
+		if len(a) > 1 && a[1] == '=' {
+			attrs[a[0]] = a[2:]
+		}
+	}
+	return attrs
+}
+
+// scramClient answers the SASL exchange of a backend.
+type scramClient struct {
+	password string
+	binding  []byte // "tls-server-end-point" data of the connection, if any
+
+	header          string // gs2-header
+	nonce           string
+	clientFirstBare string
+	signature       []byte // the ServerSignature to expect
+}
+
+// initial chooses a mechanism from those offered and returns the
+// client-first-message.
+func (c *scramClient) initial(mechanisms []string) (string, []byte, error) {
+	var plain, plus bool
+	for _, m := range mechanisms {
+		plain = plain || m == scramSHA256
+		plus = plus || m == scramSHA256Plus
+	}
+
+	mechanism := scramSHA256
+	switch {
+	case plus && c.binding != nil:
+		mechanism, c.header = scramSHA256Plus, "p=tls-server-end-point,,"
+	case !plain:
+		return "", nil, fmt.Errorf("unsupported SASL mechanisms: %q", mechanisms)
+	case c.binding != nil:
+		c.header = "y,,"
+	default:
+		c.header = "n,,"
+	}
+
+	var err error
+	if c.nonce, err = scramNonce(); err != nil {
+		return "", nil, err
+	}
+
+	c.clientFirstBare = "n=,r=" + c.nonce
+	return mechanism, []byte(c.header + c.clientFirstBare), nil
+}
+
+// final returns the client-final-message in response to the
+// server-first-message.
+func (c *scramClient) final(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(string(serverFirst))
+	if !strings.HasPrefix(attrs['r'], c.nonce) || len(attrs['r']) == len(c.nonce) {
+		return nil, fmt.Errorf("invalid SCRAM nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return nil, err
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil {
+		return nil, err
+	}
+
+	binding := []byte(c.header)
+	if strings.HasPrefix(c.header, "p=") {
+		binding = append(binding, c.binding...)
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(binding) + ",r=" + attrs['r']
+	authMessage := c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+
+	salted := scramSaltedPassword(c.password, salt, iterations)
+	proof := scramHMAC(salted, "Client Key")
+	signature := scramHMAC(scramHash(proof), authMessage)
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+
+	c.signature = scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server-final-message.
+func (c *scramClient) verify(serverFinal []byte) error {
+	attrs := scramAttributes(string(serverFinal))
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("SCRAM error: %s", e)
+	}
+
+	v, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err == nil && !hmac.Equal(v, c.signature) {
+		err = fmt.Errorf("invalid SCRAM server signature")
+	}
+	return err
+}
+
+// tlsServerEndPoint is the "tls-server-end-point" channel binding data of a
+// connection, a hash of the certificate of the server. See RFC 5929.
+func tlsServerEndPoint(s tls.ConnectionState) []byte {
+	if len(s.PeerCertificates) == 0 {
+		return nil
+	}
+
+	var h hash.Hash
+	switch cert := s.PeerCertificates[0]; cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		// MD5 and SHA-1 are replaced by SHA-256.
+		h = sha256.New()
+	}
+	h.Write(s.PeerCertificates[0].Raw)
+	return h.Sum(nil)
+}
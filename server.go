@@ -2,8 +2,13 @@ package pgtwixt
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/uhoh-itsmaciek/femebe/core"
@@ -17,41 +22,146 @@ type CancellationKey struct {
 type Server struct {
 	Debug LogFunc
 	Info  LogFunc
-	tls   *tls.Config
+
+	// TLS, when set, is used to accept SSLRequest. Frontends without TLS
+	// are disconnected when RequireTLS is set, except those on Unix sockets.
+	TLS        *tls.Config
+	RequireTLS bool
+
+	// CertUser requires the common name of a verified client certificate to
+	// match the "user" of startup, like "clientcert=verify-full" of PostgreSQL.
+	// Frontends on Unix sockets are exempt, as they are from RequireTLS.
+	CertUser bool
+
+	// PeerUser requires the system user of a Unix socket frontend to match
+	// the "user" of startup, like "peer" authentication of PostgreSQL. It
+	// takes the place of Authenticate for those frontends.
+	PeerUser bool
+
+	// Authenticate, when set, verifies a frontend after startup and before
+	// Session. A frontend that fails is disconnected.
+	Authenticate func(FrontendStream, map[string]string) error
+
+	// KeepAlives* and UserTimeout apply to TCP frontends the same as they do
+	// to the backends of a TCPDialer.
+	KeepAlivesCount    int
+	KeepAlivesDisable  bool
+	KeepAlivesIdle     time.Duration
+	KeepAlivesInterval time.Duration
+	UserTimeout        time.Duration
+
+	// ProxyProtocol reads a PROXY protocol header, version 1 or 2, from TCP
+	// frontends connecting from ProxyTrusted. No address is trusted when it
+	// is empty, since any client could otherwise claim any address. The
+	// address in the header takes the place of the address of the connection
+	// in logs, limits, and FrontendStream.RemoteAddr. When ProxyRequired is
+	// set, frontends without a header are disconnected.
+	ProxyProtocol bool
+	ProxyRequired bool
+	ProxyTrusted  []*net.IPNet
+
+	// LoginTimeout, when set, limits the time a frontend has to negotiate
+	// TLS, send startup, and authenticate. A frontend that exceeds it is
+	// disconnected and counted by CountLoginTimeout.
+	LoginTimeout time.Duration
 
 	Cancel  func(CancellationKey)
 	Session func(FrontendStream, map[string]string)
 
-	CountConnect    func()
-	CountDisconnect func()
+	// MaxClientConnections limits the frontends connected at once, and
+	// MaxClientConnectionsPerIP limits those from each IP address, see
+	// ProxyProtocol. Frontends over a limit are sent a "too_many_connections"
+	// error and disconnected without waiting for startup. Zero is no limit.
+	MaxClientConnections      int
+	MaxClientConnectionsPerIP int
+
+	CountConnect      func()
+	CountDisconnect   func()
+	CountLoginTimeout func()
+
+	mu        sync.Mutex
+	perIP     map[string]int
+	draining  bool
+	drained   chan struct{} // closed when draining and no frontends remain
+	listeners map[net.Listener]struct{}
+	frontends map[*frontend]struct{}
 }
 
 func (s *Server) accept(conn net.Conn) {
+	f := &frontend{raw: conn, conn: conn, stream: core.NewFrontendStream(conn)}
+	if !s.track(f, true) {
+		_ = conn.Close()
+		return
+	}
+	defer s.track(f, false)
+
 	s.CountConnect()
-	if err := s.handshake(conn); err != nil {
-		s.Info("msg", "Error during handshake", "error", err)
+	if err := s.handshake(f); err != nil {
+		s.Info("msg", "Error during handshake", "client", f.client(), "error", err)
 	}
 }
 
 // handshake interprets the initial SSL, Startup, and/or Cancel message(s).
-func (s *Server) handshake(conn net.Conn) (err error) {
+func (s *Server) handshake(f *frontend) (err error) {
 	var msg core.Message
 	fe := FrontendStream{
-		debug:  s.Debug,
-		stream: core.NewFrontendStream(conn),
+		debug:    s.Debug,
+		stream:   f.stream,
+		conn:     f.conn,
+		frontend: f,
 	}
 	defer s.CountDisconnect()
 	defer func() { _ = fe.Close() }()
 
+	if s.LoginTimeout > 0 {
+		_ = f.raw.SetDeadline(time.Now().Add(s.LoginTimeout))
+		defer func() {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				err = fmt.Errorf("login timeout after %v: %w", s.LoginTimeout, err)
+				if s.CountLoginTimeout != nil {
+					s.CountLoginTimeout()
+				}
+			}
+		}()
+	}
+
+	if err = s.reject(f, fe); err != nil {
+		return
+	}
+	if _, tcp := f.raw.RemoteAddr().(*net.TCPAddr); tcp && s.ProxyProtocol {
+		if err = s.readProxyHeader(f, &fe); err != nil {
+			return
+		}
+	}
+	s.identify(f, fe.conn.RemoteAddr())
+	if err = s.reject(f, fe); err != nil {
+		return
+	}
+
 	if err = fe.Next(&msg); err != nil {
 		return
 	}
 
+	// Decline GSSAPI encryption with the same response as SSLRequest. The
+	// frontend may then request SSL.
+	if isGSSENCRequest(&msg) {
+		if err = msg.Discard(); err != nil {
+			return
+		}
+		if err = fe.SendSSLRequestResponse(core.RejectSSLRequest); err != nil {
+			return
+		}
+		if err = fe.Next(&msg); err != nil {
+			return
+		}
+	}
+
 	if proto.IsSSLRequest(&msg) {
 		if err = msg.Discard(); err != nil {
 			return
 		}
-		if s.tls == nil {
+		if s.TLS == nil {
 			if err = fe.SendSSLRequestResponse(core.RejectSSLRequest); err != nil {
 				return
 			}
@@ -60,22 +170,38 @@ func (s *Server) handshake(conn net.Conn) (err error) {
 				return
 			}
 
-			tlsConn := tls.Server(conn, s.tls)
+			tlsConn := tls.Server(fe.conn, s.TLS)
 			if err = tlsConn.Handshake(); err != nil {
 				return
 			}
 
 			fe.stream = core.NewFrontendStream(tlsConn)
+			fe.conn = tlsConn
+			f.upgraded(fe.conn, fe.stream)
 		}
 		if err = fe.Next(&msg); err != nil {
 			return
 		}
 	}
 
-	if proto.IsStartupMessage(&msg) {
-		var su *proto.StartupMessage
-		if su, err = proto.ReadStartupMessage(&msg); err == nil {
-			s.Session(fe, su.Params)
+	if isStartupMessage(&msg) {
+		var minor uint16
+		var startup map[string]string
+		if minor, startup, err = readStartupMessage(&msg); err != nil {
+			return fatal(fe, "08P01", fmt.Sprintf("invalid startup packet: %v", err))
+		}
+		if err = s.negotiate(f, &fe, minor, startup); err != nil {
+			return
+		}
+		err = s.verify(fe, startup)
+		if err == nil && s.Authenticate != nil && !s.peer(fe) {
+			err = s.Authenticate(fe, startup)
+		}
+		if err == nil {
+			if s.LoginTimeout > 0 {
+				_ = f.raw.SetDeadline(time.Time{})
+			}
+			s.Session(fe, startup)
 		}
 		return
 	}
@@ -91,23 +217,186 @@ func (s *Server) handshake(conn net.Conn) (err error) {
 		return
 	}
 
-	return fmt.Errorf("Unknown message: %q", msg.MsgType())
+	// Report the protocol version of a startup packet that is not 3.0.
+	if major, minor, ok := readStartupVersion(&msg); ok {
+		return fatal(fe, "08P01", fmt.Sprintf(
+			"unsupported frontend protocol %d.%d: server supports 3.0", major, minor))
+	}
+	return fatal(fe, "08P01", fmt.Sprintf("invalid startup packet: unexpected message %q", msg.MsgType()))
 }
 
+// readProxyHeader replaces the connection of a frontend with one that reports
+// the addresses of its PROXY protocol header.
+func (s *Server) readProxyHeader(f *frontend, fe *FrontendStream) error {
+	addr := f.raw.RemoteAddr().(*net.TCPAddr)
+	trusted := false
+	for _, n := range s.ProxyTrusted {
+		trusted = trusted || n.Contains(addr.IP)
+	}
+
+	found := false
+	if trusted {
+		conn, ok, err := readProxyHeader(fe.conn)
+		if err != nil {
+			return err
+		}
+		found = ok
+		fe.conn, fe.stream = conn, core.NewFrontendStream(conn)
+		f.upgraded(fe.conn, fe.stream)
+	}
+
+	if s.ProxyRequired && !found {
+		if !trusted {
+			return fmt.Errorf("%v is not a trusted proxy", addr)
+		}
+		return errors.New("missing PROXY protocol header")
+	}
+	return nil
+}
+
+// negotiate answers a StartupMessage of a newer minor version or with protocol
+// options, "_pq_.*", by reporting that the Server supports only version 3.0
+// without options. The options are removed from startup.
+func (s *Server) negotiate(f *frontend, fe *FrontendStream, minor uint16, startup map[string]string) error {
+	var options []string
+	for name := range startup {
+		if strings.HasPrefix(name, "_pq_.") {
+			options = append(options, name)
+			delete(startup, name)
+		}
+	}
+	if minor == 0 && len(options) == 0 {
+		return nil
+	}
+
+	// The stream of femebe leaves its startup phase only after version 3.0.
+	if minor > 0 {
+		fe.stream = core.NewBackendStream(fe.conn)
+		f.upgraded(fe.conn, fe.stream)
+	}
+
+	var msg core.Message
+	sort.Strings(options)
+	initNegotiateProtocolVersion(&msg, 0, options)
+	if err := fe.Send(&msg); err != nil {
+		return err
+	}
+	return fe.Flush()
+}
+
+// verify checks the connection of a frontend against RequireTLS, CertUser, and
+// PeerUser.
+func (s *Server) verify(fe FrontendStream, startup map[string]string) error {
+	tc, ok := fe.conn.(*tls.Conn)
+	_, local := fe.conn.(*net.UnixConn)
+
+	if s.RequireTLS && !ok && !local {
+		return fatal(fe, "28000", "connection requires SSL")
+	}
+	if s.CertUser && !local {
+		var cn string
+		if ok && len(tc.ConnectionState().VerifiedChains) > 0 {
+			cn = tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		if cn == "" || cn != startup["user"] {
+			return fatal(fe, "28000", fmt.Sprintf(
+				"certificate authentication failed for user %q", startup["user"]))
+		}
+	}
+	if s.peer(fe) {
+		name, err := peerUser(fe.conn.(*net.UnixConn))
+		if err != nil || name != startup["user"] {
+			return fatal(fe, "28000", fmt.Sprintf(
+				"peer authentication failed for user %q", startup["user"]))
+		}
+	}
+	return nil
+}
+
+// peer reports whether a frontend is verified by PeerUser.
+func (s *Server) peer(fe FrontendStream) bool {
+	_, ok := fe.conn.(*net.UnixConn)
+	return ok && s.PeerUser
+}
+
+// reject sends an error to a frontend over a limit of the Server so that it
+// can be disconnected. The write is limited so that the frontend cannot hold
+// its connection open.
+func (s *Server) reject(f *frontend, fe FrontendStream) error {
+	if f.rejected == "" {
+		return nil
+	}
+	_ = f.raw.SetWriteDeadline(time.Now().Add(time.Second))
+	return fatal(fe, "53300", f.rejected)
+}
+
+// fatal sends an ErrorResponse to a frontend that is about to be disconnected.
+// It returns the ErrorResponse or an error sending it.
+func fatal(fe FrontendStream, code, message string) error {
+	var msg core.Message
+	e := ErrorResponse{Fields: map[byte]string{
+		'S': "FATAL", 'V': "FATAL", 'C': code, 'M': message,
+	}}
+
+	initErrorResponse(&msg, e)
+	if err := fe.Send(&msg); err != nil {
+		return err
+	}
+	if err := fe.Flush(); err != nil {
+		return err
+	}
+	return e
+}
+
+// Serve accepts frontends from l until it fails or Shutdown is called, which
+// returns ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
 	defer l.Close()
 
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var delay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				// TODO back off
-				time.Sleep(5 * time.Millisecond)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if temporary(err) {
+				// Back off while file descriptors or memory are exhausted.
+				if delay = 2 * delay; delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay > time.Second {
+					delay = time.Second
+				}
+				s.Info("msg", "Error accepting connection", "error", err, "retry", delay)
+				time.Sleep(delay)
 				continue
 			}
 			return err
 		}
+		delay = 0
+
+		if tc, ok := conn.(*net.TCPConn); ok {
+			if err := setKeepAlives(tc, s.KeepAlivesDisable,
+				s.KeepAlivesIdle, s.KeepAlivesInterval, s.KeepAlivesCount, s.UserTimeout,
+			); err != nil {
+				s.Info("msg", "Error setting keepalives", "error", err)
+			}
+		}
 
 		go s.accept(conn)
 	}
 }
+
+// temporary reports whether Accept may succeed later.
+func temporary(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
@@ -2,12 +2,27 @@ package pgtwixt
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/uhoh-itsmaciek/femebe/core"
 	"github.com/uhoh-itsmaciek/femebe/proto"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestServerAcceptCancel(t *testing.T) {
@@ -122,3 +137,654 @@ func TestServerAcceptCancelMetrics(t *testing.T) {
 	buf.Write(sslRequest)
 	t.Run("SSL,Startup", testStartup)
 }
+
+func TestServerAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	var msg core.Message
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	conn := bufConn{nopCloser{buf}}
+	srv := Server{
+		Debug: func(...interface{}) error { return nil },
+		Info:  func(...interface{}) error { return nil },
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		result error
+	}{
+		{"Success", nil},
+		{"Failure", errors.New("nope")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			proto.InitStartupMessage(&msg, map[string]string{"user": "mary"})
+			msg.WriteTo(buf)
+
+			var authenticated, called bool
+			srv.Authenticate = func(_ FrontendStream, startup map[string]string) error {
+				authenticated = true
+				assert.Equal(t, map[string]string{"user": "mary"}, startup)
+				return tt.result
+			}
+			srv.Session = func(FrontendStream, map[string]string) { called = true }
+			srv.accept(conn)
+
+			assert.True(t, authenticated, "Expected authenticate to be called")
+			assert.Equal(t, tt.result == nil, called, "Expected session only after success")
+		})
+	}
+}
+
+func TestServerVerify(t *testing.T) {
+	t.Parallel()
+
+	cert, err := tls.X509KeyPair([]byte(localhostServerCert), []byte(localhostServerKey))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM([]byte(localhostServerCert)))
+
+	srv := Server{
+		Debug: func(...interface{}) error { return nil },
+		Info:  func(...interface{}) error { return nil },
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    pool,
+		},
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+
+	// connect sends startup, over TLS when certs is not nil, and returns the
+	// SQLSTATE of any error.
+	connect := func(t *testing.T, srv *Server, user string, certs []tls.Certificate) (string, bool) {
+		conn, client := net.Pipe()
+		defer client.Close()
+
+		var called bool
+		srv.Session = func(FrontendStream, map[string]string) { called = true }
+		done := make(chan struct{})
+		go func() { srv.accept(conn); close(done) }()
+
+		var rw io.ReadWriter = client
+		if certs != nil {
+			_, err := client.Write(sslRequest)
+			require.NoError(t, err)
+			response := make([]byte, 1)
+			_, err = io.ReadFull(client, response)
+			require.NoError(t, err)
+			require.Equal(t, byte(core.AcceptSSLRequest), response[0])
+
+			tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+			require.NoError(t, tc.Handshake())
+			rw = tc
+		}
+
+		var msg core.Message
+		proto.InitStartupMessage(&msg, map[string]string{"user": user})
+		go func() { _, _ = msg.WriteTo(rw) }()
+
+		var code string
+		if err := core.NewBackendStream(nopCloser{rw}).Next(&msg); err == nil {
+			if e, ok := readErrorResponse(&msg).(ErrorResponse); ok {
+				code = e.Fields['C']
+			}
+		}
+		client.Close()
+		<-done
+		return code, called
+	}
+
+	t.Run("RequireTLS", func(t *testing.T) {
+		srv.RequireTLS = true
+		defer func() { srv.RequireTLS = false }()
+
+		code, called := connect(t, &srv, "mary", nil)
+		assert.Equal(t, "28000", code)
+		assert.False(t, called)
+
+		_, called = connect(t, &srv, "mary", []tls.Certificate{})
+		assert.True(t, called, "Expected TLS to be accepted")
+	})
+
+	t.Run("CertUser", func(t *testing.T) {
+		srv.CertUser = true
+		defer func() { srv.CertUser = false }()
+
+		_, called := connect(t, &srv, "localhost", []tls.Certificate{cert})
+		assert.True(t, called, "Expected the common name to match the user")
+
+		code, called := connect(t, &srv, "mary", []tls.Certificate{cert})
+		assert.Equal(t, "28000", code)
+		assert.False(t, called)
+
+		code, called = connect(t, &srv, "localhost", []tls.Certificate{})
+		assert.Equal(t, "28000", code, "Expected a certificate to be required")
+		assert.False(t, called)
+	})
+}
+
+// errListener returns errs from Accept and then closes.
+type errListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return nil, errors.New("closed")
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *errListener) Close() error { return nil }
+
+func TestServerServeBackoff(t *testing.T) {
+	t.Parallel()
+
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+
+	var delays []time.Duration
+	srv := &Server{Info: func(kv ...interface{}) error {
+		for i := 0; i+1 < len(kv); i += 2 {
+			if kv[i] == "retry" {
+				delays = append(delays, kv[i+1].(time.Duration))
+			}
+		}
+		return nil
+	}}
+
+	err := srv.Serve(&errListener{errs: []error{emfile, emfile, emfile}})
+	assert.EqualError(t, err, "closed")
+	assert.Equal(t, []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+	}, delays, "Expected exponential backoff")
+}
+
+func TestServerLimits(t *testing.T) {
+	t.Parallel()
+
+	// serve starts a server whose sessions block until the test ends and
+	// returns its address.
+	serve := func(t *testing.T, total, perIP int) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+
+		release := make(chan struct{})
+		srv := &Server{
+			Debug: func(...interface{}) error { return nil },
+			Info:  func(...interface{}) error { return nil },
+
+			MaxClientConnections:      total,
+			MaxClientConnectionsPerIP: perIP,
+
+			Session: func(fe FrontendStream, _ map[string]string) {
+				var msg core.Message
+				proto.InitReadyForQuery(&msg, proto.RfqIdle)
+				_ = fe.Send(&msg)
+				_ = fe.Flush()
+				<-release
+			},
+
+			CountConnect:    func() {},
+			CountDisconnect: func() {},
+		}
+		go srv.Serve(listener)
+		t.Cleanup(func() { close(release); listener.Close() })
+
+		return listener.Addr().String()
+	}
+
+	// connect sends startup and returns the SQLSTATE of any error.
+	connect := func(t *testing.T, address string) string {
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		var msg core.Message
+		proto.InitStartupMessage(&msg, map[string]string{"user": "mary"})
+		_, err = msg.WriteTo(conn)
+		require.NoError(t, err)
+
+		require.NoError(t, core.NewBackendStream(conn).Next(&msg))
+		if e, ok := readErrorResponse(&msg).(ErrorResponse); ok {
+			return e.Fields['C']
+		}
+		return ""
+	}
+
+	// rejected returns the SQLSTATE of the error sent before startup and
+	// whether the server then disconnected.
+	rejected := func(t *testing.T, address string) (string, bool) {
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		var msg core.Message
+		var code string
+		stream := core.NewBackendStream(conn)
+		require.NoError(t, stream.Next(&msg))
+		if e, ok := readErrorResponse(&msg).(ErrorResponse); ok {
+			code = e.Fields['C']
+		}
+		return code, stream.Next(&msg) == io.EOF
+	}
+
+	t.Run("Total", func(t *testing.T) {
+		address := serve(t, 2, 0)
+
+		assert.Equal(t, "", connect(t, address))
+		assert.Equal(t, "", connect(t, address))
+
+		code, closed := rejected(t, address)
+		assert.Equal(t, "53300", code)
+		assert.True(t, closed, "Expected the server to disconnect")
+	})
+
+	t.Run("PerIP", func(t *testing.T) {
+		address := serve(t, 0, 1)
+
+		assert.Equal(t, "", connect(t, address))
+
+		code, closed := rejected(t, address)
+		assert.Equal(t, "53300", code)
+		assert.True(t, closed, "Expected the server to disconnect")
+	})
+}
+
+func TestServerLoginTimeout(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	timeouts := make(chan struct{}, 10)
+	srv := &Server{
+		Debug: func(...interface{}) error { return nil },
+		Info:  func(...interface{}) error { return nil },
+
+		LoginTimeout: 50 * time.Millisecond,
+
+		Session: func(fe FrontendStream, _ map[string]string) {
+			time.Sleep(100 * time.Millisecond)
+
+			var msg core.Message
+			proto.InitReadyForQuery(&msg, proto.RfqIdle)
+			_ = fe.Send(&msg)
+			_ = fe.Flush()
+		},
+
+		CountConnect:      func() {},
+		CountDisconnect:   func() {},
+		CountLoginTimeout: func() { timeouts <- struct{}{} },
+	}
+	go srv.Serve(listener)
+
+	t.Run("Startup", func(t *testing.T) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "Expected the server to disconnect")
+
+		select {
+		case <-timeouts:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the timeout to be counted")
+		}
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		var msg core.Message
+		proto.InitStartupMessage(&msg, map[string]string{"user": "mary"})
+		_, err = msg.WriteTo(conn)
+		require.NoError(t, err)
+
+		require.NoError(t, core.NewBackendStream(conn).Next(&msg))
+		assert.Equal(t, byte(proto.MsgReadyForQueryZ), msg.MsgType(),
+			"Expected no timeout after startup")
+		assert.Len(t, timeouts, 0)
+	})
+}
+
+func TestServerProtocolError(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	srv := &Server{
+		Debug: func(...interface{}) error { return nil },
+		Info:  func(...interface{}) error { return nil },
+
+		Session: func(FrontendStream, map[string]string) { t.Error("Expected no session") },
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+
+	// Protocol 2.0 startup of user "mary".
+	buf.Write([]byte{0, 0, 0, 19, 0, 2, 0, 0, 'u', 's', 'e', 'r', 0, 'm', 'a', 'r', 'y', 0, 0})
+	srv.accept(bufConn{nopCloser{buf}})
+
+	var msg core.Message
+	require.NoError(t, core.NewBackendStream(nopCloser{buf}).Next(&msg))
+	require.Equal(t, byte(proto.MsgErrorResponseE), msg.MsgType())
+
+	e, ok := readErrorResponse(&msg).(ErrorResponse)
+	require.True(t, ok)
+	assert.Equal(t, "08P01", e.Fields['C'])
+	assert.Equal(t, "unsupported frontend protocol 2.0: server supports 3.0", e.Fields['M'])
+}
+
+func TestServerNegotiate(t *testing.T) {
+	t.Parallel()
+
+	// startup returns a StartupMessage of protocol 3.minor.
+	startup := func(minor byte, params ...string) []byte {
+		b := []byte{0, 0, 0, 0, 0, 3, 0, minor}
+		for _, p := range params {
+			b = append(append(b, p...), 0)
+		}
+		b = append(b, 0)
+		b[3] = byte(len(b))
+		return b
+	}
+	gssencRequest := []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x30}
+
+	for _, tt := range []struct {
+		name     string
+		input    [][]byte
+		response []byte
+		minor    uint32
+		options  []string
+	}{
+		{name: "3.0", input: [][]byte{startup(0, "user", "mary")}},
+		{
+			name:  "3.2",
+			input: [][]byte{startup(2, "user", "mary")},
+			minor: 0, options: []string{},
+		},
+		{
+			name:  "Options",
+			input: [][]byte{startup(0, "user", "mary", "_pq_.b", "on", "_pq_.a", "1")},
+			minor: 0, options: []string{"_pq_.a", "_pq_.b"},
+		},
+		{
+			name:     "GSSENC",
+			input:    [][]byte{gssencRequest, startup(0, "user", "mary")},
+			response: []byte{'N'},
+		},
+		{
+			name:     "GSSENC,SSL",
+			input:    [][]byte{gssencRequest, sslRequest, startup(1, "user", "mary")},
+			response: []byte{'N', 'N'},
+			options:  []string{},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var msg core.Message
+			in, out := new(bytes.Buffer), new(bytes.Buffer)
+			for _, b := range tt.input {
+				in.Write(b)
+			}
+			proto.InitQuery(&msg, "SELECT 1")
+			msg.WriteTo(in)
+
+			var called bool
+			srv := &Server{
+				Debug: func(...interface{}) error { return nil },
+				Info:  func(...interface{}) error { return nil },
+
+				Session: func(fe FrontendStream, startup map[string]string) {
+					called = true
+					assert.Equal(t, map[string]string{"user": "mary"}, startup)
+
+					var msg core.Message
+					require.NoError(t, fe.Next(&msg))
+					assert.Equal(t, byte(proto.MsgQueryQ), msg.MsgType(),
+						"Expected the stream to leave startup")
+				},
+
+				CountConnect:    func() {},
+				CountDisconnect: func() {},
+			}
+			srv.accept(bufConn{nopCloser{struct {
+				io.Reader
+				io.Writer
+			}{in, out}}})
+			assert.True(t, called, "Expected session to be called")
+
+			response := out.Next(len(tt.response))
+			assert.Equal(t, string(tt.response), string(response))
+
+			if tt.options == nil {
+				assert.Equal(t, 0, out.Len(), "Expected no negotiation")
+				return
+			}
+
+			require.NoError(t, core.NewBackendStream(nopCloser{out}).Next(&msg))
+			require.Equal(t, byte('v'), msg.MsgType())
+
+			b, err := msg.Force()
+			require.NoError(t, err)
+			require.True(t, len(b) >= 8)
+			assert.Equal(t, tt.minor, binary.BigEndian.Uint32(b))
+			assert.Equal(t, uint32(len(tt.options)), binary.BigEndian.Uint32(b[4:]))
+
+			options := []string{}
+			if len(b) > 8 {
+				options = strings.Split(strings.TrimSuffix(string(b[8:]), "\x00"), "\x00")
+			}
+			assert.Equal(t, tt.options, options)
+		})
+	}
+}
+
+func TestServerPeerUser(t *testing.T) {
+	t.Parallel()
+
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, ".s.PGSQL.5432"))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	srv := &Server{
+		Debug: func(...interface{}) error { return nil },
+		Info:  func(...interface{}) error { return nil },
+
+		RequireTLS: true,
+		CertUser:   true,
+		PeerUser:   true,
+
+		Authenticate: func(FrontendStream, map[string]string) error {
+			t.Error("Expected peer authentication in place of Authenticate")
+			return nil
+		},
+		Session: func(fe FrontendStream, _ map[string]string) {
+			var msg core.Message
+			proto.InitReadyForQuery(&msg, proto.RfqIdle)
+			_ = fe.Send(&msg)
+			_ = fe.Flush()
+		},
+
+		CountConnect:    func() {},
+		CountDisconnect: func() {},
+	}
+	go srv.Serve(listener)
+
+	for _, tt := range []struct {
+		user string
+		code string
+	}{
+		{user: current.Username},
+		{user: current.Username + "x", code: "28000"},
+	} {
+		conn, err := net.Dial("unix", listener.Addr().String())
+		require.NoError(t, err)
+
+		var msg core.Message
+		proto.InitStartupMessage(&msg, map[string]string{"user": tt.user})
+		_, err = msg.WriteTo(conn)
+		require.NoError(t, err)
+
+		require.NoError(t, core.NewBackendStream(conn).Next(&msg))
+		if tt.code == "" {
+			assert.Equal(t, byte(proto.MsgReadyForQueryZ), msg.MsgType(),
+				"Expected no TLS or certificate requirement and a session for %q", tt.user)
+		} else {
+			e, ok := readErrorResponse(&msg).(ErrorResponse)
+			require.True(t, ok)
+			assert.Equal(t, tt.code, e.Fields['C'])
+			assert.Equal(t, fmt.Sprintf("peer authentication failed for user %q", tt.user), e.Fields['M'])
+		}
+		conn.Close()
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+
+	// serve starts a server that reports the address of each session.
+	serve := func(t *testing.T, srv *Server) (string, <-chan string) {
+		listener, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+		t.Cleanup(func() { listener.Close() })
+
+		addrs := make(chan string, 1)
+		srv.Debug = func(...interface{}) error { return nil }
+		srv.Info = func(...interface{}) error { return nil }
+		srv.Session = func(fe FrontendStream, _ map[string]string) {
+			addrs <- fe.RemoteAddr().String()
+
+			var msg core.Message
+			proto.InitReadyForQuery(&msg, proto.RfqIdle)
+			_ = fe.Send(&msg)
+			_ = fe.Flush()
+		}
+		srv.CountConnect = func() {}
+		srv.CountDisconnect = func() {}
+
+		go srv.Serve(listener)
+		return listener.Addr().String(), addrs
+	}
+
+	// connect sends header and startup and returns the first response.
+	connect := func(t *testing.T, address, header string) (byte, error) {
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// The server may disconnect before startup.
+		var msg core.Message
+		proto.InitStartupMessage(&msg, map[string]string{"user": "mary"})
+		if _, err = io.WriteString(conn, header); err == nil {
+			_, err = msg.WriteTo(conn)
+		}
+		if err == nil {
+			err = core.NewBackendStream(conn).Next(&msg)
+		}
+		return msg.MsgType(), err
+	}
+
+	t.Run("Accept", func(t *testing.T) {
+		address, addrs := serve(t, &Server{
+			ProxyProtocol: true, ProxyTrusted: []*net.IPNet{loopback}, MaxClientConnectionsPerIP: 1,
+		})
+
+		msgType, err := connect(t, address, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n")
+		require.NoError(t, err)
+		assert.Equal(t, byte(proto.MsgReadyForQueryZ), msgType)
+		assert.Equal(t, "192.0.2.1:56324", <-addrs)
+
+		msgType, err = connect(t, address, "")
+		require.NoError(t, err)
+		assert.Equal(t, byte(proto.MsgReadyForQueryZ), msgType)
+		assert.Contains(t, <-addrs, "127.0.0.1:")
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		cert, err := tls.X509KeyPair([]byte(localhostServerCert), []byte(localhostServerKey))
+		require.NoError(t, err)
+		address, addrs := serve(t, &Server{
+			ProxyProtocol: true,
+			ProxyTrusted:  []*net.IPNet{loopback},
+			TLS:           &tls.Config{Certificates: []tls.Certificate{cert}},
+		})
+
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = io.WriteString(conn, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 5432\r\n")
+		require.NoError(t, err)
+		_, err = conn.Write(sslRequest)
+		require.NoError(t, err)
+
+		response := make([]byte, 1)
+		_, err = io.ReadFull(conn, response)
+		require.NoError(t, err)
+		require.Equal(t, "S", string(response))
+
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		var msg core.Message
+		proto.InitStartupMessage(&msg, map[string]string{"user": "mary"})
+		_, err = msg.WriteTo(tc)
+		require.NoError(t, err)
+
+		require.NoError(t, core.NewBackendStream(tc).Next(&msg))
+		assert.Equal(t, byte(proto.MsgReadyForQueryZ), msg.MsgType())
+		assert.Equal(t, "[2001:db8::1]:56324", <-addrs, "Expected the address of the header after TLS")
+	})
+
+	t.Run("Require", func(t *testing.T) {
+		address, _ := serve(t, &Server{ProxyProtocol: true, ProxyRequired: true, ProxyTrusted: []*net.IPNet{loopback}})
+
+		_, err := connect(t, address, "")
+		assert.Error(t, err, "Expected a disconnect without a header")
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+		require.NoError(t, err)
+		address, addrs := serve(t, &Server{ProxyProtocol: true, ProxyTrusted: []*net.IPNet{trusted}})
+
+		msgType, err := connect(t, address, "")
+		require.NoError(t, err)
+		assert.Equal(t, byte(proto.MsgReadyForQueryZ), msgType)
+		assert.Contains(t, <-addrs, "127.0.0.1:", "Expected the address of the connection")
+
+		address, _ = serve(t, &Server{ProxyProtocol: true, ProxyRequired: true, ProxyTrusted: []*net.IPNet{trusted}})
+		_, err = connect(t, address, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n")
+		assert.Error(t, err, "Expected a disconnect of an untrusted proxy")
+
+		address, _ = serve(t, &Server{ProxyProtocol: true, ProxyRequired: true})
+		_, err = connect(t, address, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5432\r\n")
+		assert.Error(t, err, "Expected no proxy to be trusted by default")
+	})
+}
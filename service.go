@@ -0,0 +1,64 @@
+package pgtwixt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ServiceFile is a connection service file like ~/.pg_service.conf. Each
+// "[name]" section holds the keywords and values of a connection string.
+//
+// https://www.postgresql.org/docs/current/libpq-pgservice.html
+type ServiceFile map[string]map[string]string
+
+// ReadServiceFile parses a connection service file. Blank lines and lines
+// that start with "#" are ignored.
+func ReadServiceFile(r io.Reader) (ServiceFile, error) {
+	f := make(ServiceFile)
+	s := bufio.NewScanner(r)
+
+	var section map[string]string
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %d: expected ']'", n)
+			}
+			name := line[1 : len(line)-1]
+			if section = f[name]; section == nil {
+				section = make(map[string]string)
+				f[name] = section
+			}
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		switch {
+		case i < 0:
+			return nil, fmt.Errorf("line %d: expected '='", n)
+		case section == nil:
+			return nil, fmt.Errorf("line %d: expected a [service] before settings", n)
+		case strings.TrimSpace(line[:i]) == "service":
+			return nil, fmt.Errorf("line %d: nested service specifications are not supported", n)
+		}
+		section[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+
+	return f, s.Err()
+}
+
+// ConnectionString returns the settings of a service.
+func (f ServiceFile) ConnectionString(name string) (ConnectionString, bool) {
+	c := ConnectionString{Remainder: make(map[string]string)}
+	section, ok := f[name]
+	for key, value := range section {
+		c.set(key, value)
+	}
+	return c, ok
+}
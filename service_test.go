@@ -0,0 +1,96 @@
+package pgtwixt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadServiceFile(t *testing.T) {
+	t.Parallel()
+
+	f, err := ReadServiceFile(strings.NewReader(`
+# comment
+[mydb]
+host=somehost
+port = 5433
+user=admin
+
+[other]
+dbname=x
+unknown=y
+`))
+	require.NoError(t, err)
+	assert.Equal(t, ServiceFile{
+		"mydb":  {"host": "somehost", "port": "5433", "user": "admin"},
+		"other": {"dbname": "x", "unknown": "y"},
+	}, f)
+
+	cs, ok := f.ConnectionString("other")
+	assert.True(t, ok)
+	assert.Equal(t, ConnectionString{
+		Database: "x", Remainder: map[string]string{"unknown": "y"},
+	}, cs)
+
+	_, ok = f.ConnectionString("missing")
+	assert.False(t, ok)
+
+	for _, input := range []string{
+		"host=before",
+		"[unclosed\nhost=x",
+		"[a]\nnovalue",
+		"[a]\nservice=b",
+	} {
+		_, err := ReadServiceFile(strings.NewReader(input))
+		assert.Error(t, err, "%q", input)
+	}
+}
+
+func TestConnectionStringMerge(t *testing.T) {
+	t.Parallel()
+
+	cs := ConnectionString{
+		Host:      []string{"explicit"},
+		User:      "explicit",
+		Remainder: map[string]string{"a": "explicit"},
+	}
+	cs.Merge(ConnectionString{
+		Host:      []string{"a", "b"},
+		Port:      []string{"1", "2"},
+		User:      "default",
+		Database:  "default",
+		Remainder: map[string]string{"a": "default", "b": "default"},
+	})
+
+	assert.Equal(t, ConnectionString{
+		Host:      []string{"explicit"},
+		Port:      []string{"1", "2"},
+		User:      "explicit",
+		Database:  "default",
+		Remainder: map[string]string{"a": "explicit", "b": "default"},
+	}, cs)
+
+	var empty ConnectionString
+	empty.Merge(ConnectionString{Remainder: map[string]string{"x": "y"}})
+	assert.Equal(t, map[string]string{"x": "y"}, empty.Remainder)
+
+	t.Run("EveryField", func(t *testing.T) {
+		var full ConnectionString
+		fv := reflect.ValueOf(&full).Elem()
+		for i := 0; i < fv.NumField(); i++ {
+			switch f := fv.Field(i); f.Kind() {
+			case reflect.String:
+				f.SetString(fv.Type().Field(i).Name)
+			case reflect.Slice:
+				f.Set(reflect.ValueOf([]string{fv.Type().Field(i).Name}))
+			}
+		}
+
+		var merged ConnectionString
+		merged.Merge(full)
+		assert.Equal(t, full, merged)
+	})
+}
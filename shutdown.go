@@ -0,0 +1,323 @@
+package pgtwixt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("pgtwixt: Server closed")
+
+var errFrontendClosed = errors.New("frontend disconnected by shutdown")
+
+// frontend follows the transaction status of a frontend so that Shutdown can
+// disconnect it between transactions.
+type frontend struct {
+	raw net.Conn   // the connection before any TLS upgrade
+	wmu sync.Mutex // held while writing so that terminate does not interleave
+
+	mu       sync.Mutex
+	conn     net.Conn
+	stream   *core.MessageStream
+	ready    bool             // a ReadyForQuery was sent
+	status   proto.ConnStatus // of the last ReadyForQuery
+	pending  int              // Query, FunctionCall, and Sync messages without ReadyForQuery
+	partial  bool             // extended query messages since the last Sync
+	draining bool
+	closed   bool
+
+	addr     net.Addr // of the client, see Server.ProxyProtocol
+	ip       string   // of a TCP client
+	rejected string   // reason the frontend exceeds a limit of the Server
+}
+
+// idle reports whether the frontend is between transactions. The caller must
+// hold the lock.
+func (f *frontend) idle() bool {
+	return f.ready && f.status == proto.RfqIdle && f.pending == 0 && !f.partial
+}
+
+// upgraded records the connection of a frontend after TLS.
+func (f *frontend) upgraded(conn net.Conn, stream *core.MessageStream) {
+	f.mu.Lock()
+	f.conn, f.stream = conn, stream
+	f.mu.Unlock()
+}
+
+// received records a message from the frontend.
+func (f *frontend) received(msgType byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch msgType {
+	case proto.MsgQueryQ, proto.MsgFunctionCallF:
+		f.pending++
+	case proto.MsgSyncS:
+		f.pending++
+		f.partial = false
+	case proto.MsgParseP, proto.MsgBindB, proto.MsgExecuteE,
+		proto.MsgDescribeD, proto.MsgCloseC, proto.MsgFlushH:
+		f.partial = true
+	}
+}
+
+// send records a message to the frontend and sends it.
+func (f *frontend) send(m *core.Message, send func() error) error {
+	if err := f.sending(m); err != nil {
+		return err
+	}
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	return send()
+}
+
+// sending records a message before it is sent to the frontend.
+func (f *frontend) sending(m *core.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return errFrontendClosed
+	}
+	if m.MsgType() == proto.MsgReadyForQueryZ {
+		status, err := readReadyForQuery(m)
+		if err != nil {
+			return err
+		}
+		f.ready, f.status = true, status
+		if f.pending > 0 {
+			f.pending--
+		}
+	}
+	return nil
+}
+
+// flush flushes messages to the frontend. A frontend that is draining is
+// disconnected once it is idle.
+func (f *frontend) flush(flush func() error) error {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+
+	if closed {
+		return errFrontendClosed
+	}
+
+	f.wmu.Lock()
+	err := flush()
+	f.wmu.Unlock()
+
+	if err == nil && f.drained() {
+		f.terminate()
+	}
+	return err
+}
+
+// drain disconnects the frontend now when it is idle or otherwise after its
+// current transaction.
+func (f *frontend) drain() {
+	f.mu.Lock()
+	f.draining = true
+	f.mu.Unlock()
+
+	if f.drained() {
+		f.terminate()
+	}
+}
+
+// drained reports whether the frontend is draining and idle.
+func (f *frontend) drained() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.draining && f.idle()
+}
+
+// terminate sends an ErrorResponse like that of a PostgreSQL shutdown and
+// closes the connection. It waits for any write in progress to finish.
+func (f *frontend) terminate() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	conn, stream := f.conn, f.stream
+	f.mu.Unlock()
+
+	var msg core.Message
+	initErrorResponse(&msg, ErrorResponse{Fields: map[byte]string{
+		'S': "FATAL", 'V': "FATAL", 'C': "57P01",
+		'M': "terminating connection due to administrator command",
+	}})
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := stream.Send(&msg); err == nil {
+		_ = stream.Flush()
+	}
+	_ = conn.Close()
+}
+
+// client returns the address of the client of the frontend.
+func (f *frontend) client() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.addr != nil {
+		return f.addr
+	}
+	return f.raw.RemoteAddr()
+}
+
+// track records a frontend until it disconnects. It returns false when the
+// Server is shutting down. A frontend over a limit of the Server is counted
+// and recorded as rejected so that handshake can report it.
+func (s *Server) track(f *frontend, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		if _, ok := s.frontends[f]; ok {
+			delete(s.frontends, f)
+			if f.ip != "" {
+				if s.perIP[f.ip]--; s.perIP[f.ip] <= 0 {
+					delete(s.perIP, f.ip)
+				}
+			}
+			if s.draining && len(s.frontends) == 0 {
+				close(s.drained)
+			}
+		}
+		return true
+	}
+	if s.draining {
+		return false
+	}
+	if s.frontends == nil {
+		s.frontends = make(map[*frontend]struct{})
+		s.perIP = make(map[string]int)
+	}
+	s.frontends[f] = struct{}{}
+
+	if s.MaxClientConnections > 0 && len(s.frontends) > s.MaxClientConnections {
+		f.rejected = "sorry, too many clients already"
+	}
+	return true
+}
+
+// identify records the address of the client of a tracked frontend and counts
+// it against MaxClientConnectionsPerIP.
+func (s *Server) identify(f *frontend, addr net.Addr) {
+	f.mu.Lock()
+	f.addr = addr
+	f.mu.Unlock()
+
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f.ip = tcp.IP.String()
+	s.perIP[f.ip]++
+
+	if f.rejected == "" && s.MaxClientConnectionsPerIP > 0 && s.perIP[f.ip] > s.MaxClientConnectionsPerIP {
+		f.rejected = fmt.Sprintf("too many connections from host %q", f.ip)
+	}
+}
+
+// trackListener records a listener until Serve returns. It returns false when
+// the Server is shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.draining {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Shutdown stops accepting connections and disconnects each frontend once it
+// is between transactions. When ctx is done first, the remaining frontends are
+// disconnected in the middle of their transactions and ctx.Err() is returned.
+// Either way, frontends are sent a FATAL ErrorResponse with SQLSTATE 57P01.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.draining {
+		s.draining = true
+		s.drained = make(chan struct{})
+		if len(s.frontends) == 0 {
+			close(s.drained)
+		}
+	}
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	frontends := s.remaining()
+	drained := s.drained
+	s.mu.Unlock()
+
+	for _, f := range frontends {
+		go f.drain()
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	frontends = s.remaining()
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, f := range frontends {
+		wg.Add(1)
+		go func(f *frontend) {
+			defer wg.Done()
+
+			// Interrupt any write that terminate would wait for.
+			_ = f.raw.SetWriteDeadline(time.Now().Add(time.Second))
+			f.terminate()
+		}(f)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// remaining returns the frontends that have not disconnected. The caller must
+// hold the lock.
+func (s *Server) remaining() []*frontend {
+	frontends := make([]*frontend, 0, len(s.frontends))
+	for f := range s.frontends {
+		frontends = append(frontends, f)
+	}
+	return frontends
+}
@@ -0,0 +1,138 @@
+package pgtwixt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+func TestServerShutdown(t *testing.T) {
+	t.Parallel()
+
+	// serve starts a Server whose sessions answer "BEGIN" and "COMMIT" with
+	// the transaction status of PostgreSQL.
+	serve := func(t *testing.T) (*Server, net.Addr, <-chan error) {
+		listener, err := net.Listen("tcp", "127.0.0.1:")
+		require.NoError(t, err)
+
+		srv := &Server{
+			Debug: func(...interface{}) error { return nil },
+			Info:  func(...interface{}) error { return nil },
+
+			CountConnect:    func() {},
+			CountDisconnect: func() {},
+		}
+		srv.Session = func(fe FrontendStream, _ map[string]string) {
+			var msg core.Message
+			status := proto.RfqIdle
+
+			for {
+				proto.InitReadyForQuery(&msg, status)
+				if fe.Send(&msg) != nil || fe.Flush() != nil {
+					return
+				}
+				if fe.Next(&msg) != nil {
+					return
+				}
+				b, _ := msg.Force()
+				if string(b) == "BEGIN\x00" {
+					status = proto.RfqInTrans
+				} else {
+					status = proto.RfqIdle
+				}
+			}
+		}
+
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(listener) }()
+		return srv, listener.Addr(), served
+	}
+
+	// connect completes startup and returns a stream of the messages from
+	// the server.
+	connect := func(t *testing.T, addr net.Addr) (net.Conn, *core.MessageStream) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+
+		var msg core.Message
+		proto.InitStartupMessage(&msg, map[string]string{"user": "mary"})
+		_, err = msg.WriteTo(conn)
+		require.NoError(t, err)
+
+		be := core.NewBackendStream(conn)
+		require.NoError(t, be.Next(&msg))
+		require.Equal(t, byte(proto.MsgReadyForQueryZ), msg.MsgType())
+		return conn, be
+	}
+
+	query := func(t *testing.T, conn net.Conn, be *core.MessageStream, sql string) proto.ConnStatus {
+		var msg core.Message
+		proto.InitQuery(&msg, sql)
+		_, err := msg.WriteTo(conn)
+		require.NoError(t, err)
+		require.NoError(t, be.Next(&msg))
+		status, err := readReadyForQuery(&msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	terminated := func(t *testing.T, be *core.MessageStream) {
+		var msg core.Message
+		require.NoError(t, be.Next(&msg))
+		require.Equal(t, byte(proto.MsgErrorResponseE), msg.MsgType())
+		e, ok := readErrorResponse(&msg).(ErrorResponse)
+		require.True(t, ok)
+		assert.Equal(t, "57P01", e.Fields['C'])
+		assert.Error(t, be.Next(&msg), "Expected the connection to close")
+	}
+
+	t.Run("Drain", func(t *testing.T) {
+		srv, addr, served := serve(t)
+
+		idleConn, idle := connect(t, addr)
+		defer idleConn.Close()
+		busyConn, busy := connect(t, addr)
+		defer busyConn.Close()
+		require.Equal(t, proto.ConnStatus(proto.RfqInTrans), query(t, busyConn, busy, "BEGIN"))
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+		assert.Equal(t, ErrServerClosed, <-served)
+		terminated(t, idle)
+
+		select {
+		case <-shutdown:
+			t.Fatal("Expected Shutdown to wait for the transaction")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		assert.Equal(t, proto.RfqIdle, query(t, busyConn, busy, "COMMIT"))
+		terminated(t, busy)
+		assert.NoError(t, <-shutdown)
+
+		_, err := net.Dial("tcp", addr.String())
+		assert.Error(t, err, "Expected no more connections")
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		srv, addr, served := serve(t)
+
+		conn, be := connect(t, addr)
+		defer conn.Close()
+		require.Equal(t, proto.ConnStatus(proto.RfqInTrans), query(t, conn, be, "BEGIN"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+		assert.Equal(t, ErrServerClosed, <-served)
+		terminated(t, be)
+	})
+}
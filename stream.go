@@ -1,10 +1,18 @@
 package pgtwixt
 
-import "github.com/uhoh-itsmaciek/femebe/core"
+import (
+	"net"
+
+	"github.com/uhoh-itsmaciek/femebe/core"
+)
 
 type loggedStream struct {
 	debug  LogFunc
 	stream *core.MessageStream
+	dialer Dialer   // the Dialer that opened a backend
+	conn   net.Conn // the connection, after any TLS upgrade
+
+	frontend *frontend // the transaction status of a frontend of a Server
 }
 
 func (s loggedStream) log(dir string, m *core.Message) {
@@ -52,11 +60,33 @@ func (be BackendStream) Send(m *core.Message) error { return (loggedStream)(be).
 type FrontendStream loggedStream
 
 func (fe FrontendStream) Close() error  { return fe.stream.Close() }
-func (fe FrontendStream) Flush() error  { return fe.stream.Flush() }
 func (fe FrontendStream) HasNext() bool { return fe.stream.HasNext() }
 
-func (fe FrontendStream) Next(m *core.Message) error { return (loggedStream)(fe).Next("F> ", m) }
-func (fe FrontendStream) Send(m *core.Message) error { return (loggedStream)(fe).Send("F< ", m) }
+func (fe FrontendStream) Flush() error {
+	if fe.frontend != nil {
+		return fe.frontend.flush(fe.stream.Flush)
+	}
+	return fe.stream.Flush()
+}
+
+func (fe FrontendStream) Next(m *core.Message) error {
+	err := (loggedStream)(fe).Next("F> ", m)
+	if err == nil && fe.frontend != nil {
+		fe.frontend.received(m.MsgType())
+	}
+	return err
+}
+
+func (fe FrontendStream) Send(m *core.Message) error {
+	if fe.frontend != nil {
+		return fe.frontend.send(m, func() error { return (loggedStream)(fe).Send("F< ", m) })
+	}
+	return (loggedStream)(fe).Send("F< ", m)
+}
+
+// RemoteAddr returns the address of the frontend, which is that of its PROXY
+// protocol header when there is one.
+func (fe FrontendStream) RemoteAddr() net.Addr { return fe.conn.RemoteAddr() }
 
 func (fe FrontendStream) SendSSLRequestResponse(r byte) error {
 	return (loggedStream)(fe).SendSSLRequestResponse("F< ", r)
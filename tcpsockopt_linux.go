@@ -0,0 +1,36 @@
+package pgtwixt
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCP_USER_TIMEOUT is missing from package syscall.
+const tcpUserTimeout = 0x12
+
+// setTCPSockopts sets the keepalive idle time, keepalive interval, keepalive
+// count, and user timeout of conn. Zero leaves the current setting.
+func setTCPSockopts(conn *net.TCPConn, idle, interval time.Duration, count int, userTimeout time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		set := func(opt, value int) {
+			if serr == nil && value > 0 {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt, value)
+			}
+		}
+		set(syscall.TCP_KEEPIDLE, int(idle/time.Second))
+		set(syscall.TCP_KEEPINTVL, int(interval/time.Second))
+		set(syscall.TCP_KEEPCNT, count)
+		set(tcpUserTimeout, int(userTimeout/time.Millisecond))
+	})
+	if err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package pgtwixt
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetKeepAlives(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	tc := conn.(*net.TCPConn)
+	require.NoError(t, setKeepAlives(tc, false, time.Minute, 5*time.Second, 3, 30*time.Second))
+
+	raw, err := tc.SyscallConn()
+	require.NoError(t, err)
+
+	get := func(level, opt int) (value int) {
+		require.NoError(t, raw.Control(func(fd uintptr) {
+			value, err = syscall.GetsockoptInt(int(fd), level, opt)
+		}))
+		require.NoError(t, err)
+		return value
+	}
+
+	assert.Equal(t, 1, get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 60, get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+	assert.Equal(t, 5, get(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+	assert.Equal(t, 3, get(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT))
+	assert.Equal(t, 30000, get(syscall.IPPROTO_TCP, tcpUserTimeout))
+
+	require.NoError(t, setKeepAlives(tc, false, 2*time.Minute, 0, 0, 0))
+	assert.Equal(t, 120, get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+	assert.Equal(t, 5, get(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL), "Expected the interval to remain")
+
+	require.NoError(t, setKeepAlives(tc, true, time.Minute, 0, 0, 0))
+	assert.Equal(t, 0, get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+}
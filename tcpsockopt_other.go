@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package pgtwixt
+
+import (
+	"net"
+	"time"
+)
+
+// setTCPSockopts sets only the keepalive idle time on this platform, where
+// package net may set the interval along with it. The keepalive count remains
+// the system default and there is no user timeout.
+func setTCPSockopts(conn *net.TCPConn, idle, interval time.Duration, count int, userTimeout time.Duration) error {
+	if idle > 0 {
+		return conn.SetKeepAlivePeriod(idle)
+	}
+	return nil
+}
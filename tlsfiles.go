@@ -0,0 +1,213 @@
+package pgtwixt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSFiles holds a certificate, its key, certificate authorities, and a
+// certificate revocation list read from files. Load replaces them while
+// connections continue to use them through the functions of a tls.Config.
+type TLSFiles struct {
+	CertFile, KeyFile string
+	CAFile            string
+	CRLFile           string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	crl      *x509.RevocationList
+	modified map[string]time.Time
+}
+
+// Load reads all the files. When any of them cannot be read, nothing is
+// replaced.
+func (f *TLSFiles) Load() error {
+	var cert *tls.Certificate
+	var pool *x509.CertPool
+	var cas []*x509.Certificate
+	var crl *x509.RevocationList
+	modified := make(map[string]time.Time)
+
+	for _, name := range []string{f.CertFile, f.KeyFile, f.CAFile, f.CRLFile} {
+		if name != "" {
+			info, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			modified[name] = info.ModTime()
+		}
+	}
+
+	if f.CertFile != "" || f.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	if f.CAFile != "" {
+		b, err := ioutil.ReadFile(f.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if ca, err := x509.ParseCertificate(block.Bytes); err == nil {
+				pool.AddCert(ca)
+				cas = append(cas, ca)
+			}
+		}
+		if len(cas) == 0 {
+			return fmt.Errorf("no certificates in %q", f.CAFile)
+		}
+	}
+
+	if f.CRLFile != "" {
+		b, err := ioutil.ReadFile(f.CRLFile)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode(b); block != nil && block.Type == "X509 CRL" {
+			b = block.Bytes
+		}
+		if crl, err = x509.ParseRevocationList(b); err != nil {
+			return fmt.Errorf("parsing %q: %v", f.CRLFile, err)
+		}
+		if err = verifyCRL(crl, cas, time.Now()); err != nil {
+			return fmt.Errorf("verifying %q: %v", f.CRLFile, err)
+		}
+	}
+
+	f.mu.Lock()
+	f.cert, f.pool, f.crl, f.modified = cert, pool, crl, modified
+	f.mu.Unlock()
+	return nil
+}
+
+// verifyCRL checks that crl is signed by one of cas and has not passed its
+// next update.
+func verifyCRL(crl *x509.RevocationList, cas []*x509.Certificate, now time.Time) error {
+	if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+		return fmt.Errorf("revocation list expired at %v", crl.NextUpdate)
+	}
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("revocation list is not signed by a certificate authority of CAFile")
+}
+
+// changed reports whether any of the files have been modified since Load.
+func (f *TLSFiles) changed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for name, t := range f.modified {
+		if info, err := os.Stat(name); err == nil && !info.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch calls Load whenever the files change until ctx is done. Errors are
+// reported to info and the previous files remain in use.
+func (f *TLSFiles) Watch(ctx context.Context, interval time.Duration, info LogFunc) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+			if !f.changed() {
+				continue
+			}
+			if err := f.Load(); err != nil {
+				info("msg", "Error reloading TLS files", "error", err)
+			} else {
+				info("msg", "Reloaded TLS files", "cert", f.CertFile, "ca", f.CAFile)
+			}
+		}
+	}
+}
+
+// CertPool returns the certificate authorities of CAFile.
+func (f *TLSFiles) CertPool() *x509.CertPool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.pool
+}
+
+// Revoked reports whether cert is listed in CRLFile. The list was verified
+// against CAFile by Load.
+func (f *TLSFiles) Revoked(cert *x509.Certificate) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.crl == nil || !bytes.Equal(f.crl.RawIssuer, cert.RawIssuer) {
+		return false
+	}
+	for _, entry := range f.crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate is for the tls.Config of a server.
+func (f *TLSFiles) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.cert == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	return f.cert, nil
+}
+
+// GetClientCertificate is for the tls.Config of a client. A client without a
+// certificate sends none.
+func (f *TLSFiles) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.cert == nil {
+		return new(tls.Certificate), nil
+	}
+	return f.cert, nil
+}
+
+// ServerConfig returns a tls.Config that uses the latest certificate and
+// certificate authorities for each connection. The certificate authorities
+// verify client certificates.
+func (f *TLSFiles) ServerConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.Certificates = nil
+	cfg.GetCertificate = f.GetCertificate
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.Certificates = nil
+		c.GetCertificate = f.GetCertificate
+		c.ClientCAs = f.CertPool()
+		return c, nil
+	}
+	return cfg
+}
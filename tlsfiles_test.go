@@ -0,0 +1,163 @@
+package pgtwixt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// localhostServerCRL returns a PEM revocation list in which localhostServerCert
+// revokes itself.
+func localhostServerCRL(t *testing.T) []byte {
+	pair, err := tls.X509KeyPair([]byte(localhostServerCert), []byte(localhostServerKey))
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, cert, pair.PrivateKey.(crypto.Signer))
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestTLSFiles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgtwixt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	require.NoError(t, ioutil.WriteFile(certFile, []byte(localhostServerCert), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(localhostServerKey), 0600))
+
+	var empty TLSFiles
+	require.NoError(t, empty.Load())
+	_, err = empty.GetCertificate(nil)
+	assert.Error(t, err, "Expected a server to need a certificate")
+	cert, err := empty.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Empty(t, cert.Certificate, "Expected a client to send no certificate")
+
+	files := TLSFiles{CertFile: certFile, KeyFile: keyFile, CAFile: certFile}
+	require.NoError(t, files.Load())
+	assert.NotNil(t, files.CertPool())
+	assert.False(t, files.changed())
+
+	loaded, err := files.GetCertificate(nil)
+	require.NoError(t, err)
+
+	t.Run("Changed", func(t *testing.T) {
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+		assert.True(t, files.changed())
+	})
+
+	t.Run("Broken", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+		assert.Error(t, files.Load())
+
+		current, err := files.GetCertificate(nil)
+		require.NoError(t, err)
+		assert.True(t, loaded == current, "Expected the previous certificate to remain")
+	})
+
+	t.Run("CRL", func(t *testing.T) {
+		crlFile := filepath.Join(dir, "root.crl")
+		require.NoError(t, ioutil.WriteFile(crlFile, localhostServerCRL(t), 0600))
+
+		pair, err := tls.X509KeyPair([]byte(localhostServerCert), []byte(localhostServerKey))
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		require.NoError(t, err)
+
+		files := TLSFiles{CAFile: certFile, CRLFile: crlFile}
+		require.NoError(t, files.Load())
+		assert.True(t, files.Revoked(cert))
+
+		other := *cert
+		other.SerialNumber = big.NewInt(1)
+		assert.False(t, files.Revoked(&other))
+
+		unverified := TLSFiles{CRLFile: crlFile}
+		assert.Error(t, unverified.Load(), "Expected no certificate authority to verify the list")
+
+		require.NoError(t, ioutil.WriteFile(crlFile, []byte("garbage"), 0600))
+		assert.Error(t, files.Load())
+	})
+}
+
+func TestVerifyCRL(t *testing.T) {
+	t.Parallel()
+
+	pair, err := tls.X509KeyPair([]byte(localhostServerCert), []byte(localhostServerKey))
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(localhostServerCRL(t))
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.NoError(t, verifyCRL(crl, []*x509.Certificate{ca}, now))
+
+	assert.Error(t, verifyCRL(crl, nil, now), "Expected a certificate authority")
+	assert.Error(t, verifyCRL(crl, []*x509.Certificate{ca}, now.Add(2*time.Hour)),
+		"Expected an error after NextUpdate")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               ca.Subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	other, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	assert.Error(t, verifyCRL(crl, []*x509.Certificate{other}, now),
+		"Expected an authority with the same name and another key to fail")
+}
+
+func TestTCPDialerSSLFiles(t *testing.T) {
+	t.Parallel()
+
+	files := new(TLSFiles)
+	d := TCPDialer{SSLMode: "verify-ca", SSLFiles: files}
+
+	cfg := d.config()
+	assert.True(t, cfg.InsecureSkipVerify, "Expected verify-ca to verify separately")
+	assert.NotNil(t, cfg.GetClientCertificate)
+	assert.Nil(t, cfg.RootCAs)
+
+	files.pool = x509.NewCertPool()
+	assert.True(t, d.config().RootCAs == files.pool, "Expected the latest roots")
+}